@@ -0,0 +1,224 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "fmt"
+import "net"
+import "os"
+import "os/exec"
+import "strconv"
+import "strings"
+
+// First file descriptor passed by systemd, see sd_listen_fds(3)
+const listenFdsStart = 3
+
+// Build SocketSpec from the address of an inherited listener.
+func socketSpecFromAddr(addr net.Addr)(*SocketSpec) {
+	var tcp *net.TCPAddr
+	var unix *net.UnixAddr
+	var ok bool
+
+	unix, ok = addr.(*net.UnixAddr)
+	if ok {
+		return &SocketSpec{Family: "unix", Path: unix.Name}
+	}
+	tcp, ok = addr.(*net.TCPAddr)
+	if ok {
+		if tcp.IP.To4() == nil && tcp.IP != nil {
+			return &SocketSpec{Family: "inet6", Host: tcp.IP.String(), Port: tcp.Port}
+		}
+		if tcp.IP.IsUnspecified() {
+			return &SocketSpec{Family: "inet", Port: tcp.Port}
+		}
+		return &SocketSpec{Family: "inet", Host: tcp.IP.String(), Port: tcp.Port}
+	}
+	return &SocketSpec{Family: addr.Network(), Path: addr.String()}
+}
+
+// This function returns the listeners passed by systemd socket activation or
+// by a parent process using Service.Upgrade. It follows sd_listen_fds(3)
+// convention: LISTEN_FDS contains the number of file descriptors starting
+// at 3, and LISTEN_FDNAMES contains their names separated by ":". If
+// LISTEN_PID is set, it must match the current process, otherwise the
+// variables are ignored. The variables are removed from the environment so
+// they are not inherited by child processes. If no listener is passed,
+// the function returns nil without error.
+//
+// The inherited unix socket files are not removed when the listener is
+// closed because they belong to the process which created them.
+func ListenersFromEnv()([]*Listener, error) {
+	var pid string
+	var fds string
+	var names []string
+	var count int
+	var i int
+	var err error
+	var f *os.File
+	var l net.Listener
+	var listeners []*Listener
+	var listener *Listener
+	var ul *net.UnixListener
+	var ok bool
+
+	pid = os.Getenv("LISTEN_PID")
+	fds = os.Getenv("LISTEN_FDS")
+	if os.Getenv("LISTEN_FDNAMES") != "" {
+		names = strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if fds == "" {
+		return nil, nil
+	}
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	count, err = strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS value %q", fds)
+	}
+
+	for i = 0; i < count; i++ {
+		listener = &Listener{}
+		if i < len(names) {
+			listener.Name = names[i]
+		}
+
+		// net.FileListener duplicates the file descriptor, so the
+		// original one is closed.
+		f = os.NewFile(uintptr(listenFdsStart + i), listener.Name)
+		l, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, listener = range listeners {
+				listener.Close()
+			}
+			return nil, fmt.Errorf("inherited file descriptor %d: %s", listenFdsStart + i, err.Error())
+		}
+
+		// Do not remove inherited socket file on close
+		ul, ok = l.(*net.UnixListener)
+		if ok {
+			ul.SetUnlinkOnClose(false)
+		}
+
+		listener.Listener = l
+		listener.Spec = socketSpecFromAddr(l.Addr())
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+// Add to the service the listeners passed by systemd or by a parent process.
+// See ListenersFromEnv. It returns the number of inherited listeners.
+func (svc *Service)Inherit()(int, error) {
+	var listeners []*Listener
+	var err error
+
+	listeners, err = ListenersFromEnv()
+	if err != nil {
+		return 0, err
+	}
+	svc.Listeners = append(svc.Listeners, listeners...)
+	return len(listeners), nil
+}
+
+type filer interface {
+	File()(*os.File, error)
+}
+
+// This function starts a new process which inherits the service listeners.
+// It is used for zero-downtime upgrades: the new process gets the listeners
+// with Service.Inherit and starts accepting connections, then the current
+// process calls Shutdown to finish its running sessions. The listening sockets
+// are never closed, so no MTA connection is refused during the restart. argv
+// is the command line of the new process, if it is empty, the current
+// executable is started with the current arguments.
+//
+// Once the listeners are handed to the child, the unix socket files are no
+// longer removed when the current process closes its listeners.
+func (svc *Service)Upgrade(argv []string)(*os.Process, error) {
+	var cmd *exec.Cmd
+	var files []*os.File
+	var f *os.File
+	var fl filer
+	var l *Listener
+	var names []string
+	var env []string
+	var str string
+	var ul *net.UnixListener
+	var ok bool
+	var err error
+	var exe string
+
+	if len(argv) == 0 {
+		exe, err = os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		argv = append([]string{exe}, os.Args[1:]...)
+	}
+
+	defer func() {
+		for _, f = range files {
+			f.Close()
+		}
+	}()
+
+	for _, l = range svc.Listeners {
+		fl, ok = l.Listener.(filer)
+		if !ok {
+			return nil, fmt.Errorf("listener %s can't be passed to child process", l.Spec.String())
+		}
+		f, err = fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		// names are separated by ":", so the spec can't be used as name
+		if l.Name != "" {
+			names = append(names, l.Name)
+		} else {
+			names = append(names, l.Spec.Family)
+		}
+	}
+
+	// Copy environment without previous systemd variables. LISTEN_PID is
+	// not set because the child pid is not known before its start.
+	for _, str = range os.Environ() {
+		if strings.HasPrefix(str, "LISTEN_PID=") ||
+		   strings.HasPrefix(str, "LISTEN_FDS=") ||
+		   strings.HasPrefix(str, "LISTEN_FDNAMES=") {
+			continue
+		}
+		env = append(env, str)
+	}
+	env = append(env, "LISTEN_FDS=" + strconv.Itoa(len(files)))
+	env = append(env, "LISTEN_FDNAMES=" + strings.Join(names, ":"))
+
+	cmd = exec.Command(argv[0], argv[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	// The child owns the sockets now
+	for _, l = range svc.Listeners {
+		ul, ok = l.Listener.(*net.UnixListener)
+		if ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		l.path = ""
+	}
+
+	return cmd.Process, nil
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "bufio"
+import "fmt"
+import "io/ioutil"
+import "net"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "strconv"
+import "testing"
+import "time"
+
+// Not a test: this function runs in the child process started by the tests
+// below. It accepts one connection per inherited listener and answers with
+// the name and the spec of the listener.
+func Test_listenersHelper(t *testing.T) {
+	var listeners []*Listener
+	var l *Listener
+	var conn net.Conn
+	var err error
+
+	if os.Getenv("MILTER_TEST_HELPER") == "" {
+		return
+	}
+	listeners, err = ListenersFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(2)
+	}
+	for _, l = range listeners {
+		conn, err = l.Accept()
+		if err != nil {
+			os.Exit(3)
+		}
+		fmt.Fprintf(conn, "%s %s %s\n", l.Name, l.Spec.String(), os.Getenv("LISTEN_FDS"))
+		conn.Close()
+	}
+	os.Exit(0)
+}
+
+// Listen on unix socket in a temporary directory
+func testListen(t *testing.T, name string)(*Listener, string) {
+	var dir string
+	var path string
+	var l *Listener
+	var err error
+
+	dir, err = ioutil.TempDir("", "milter")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	path = filepath.Join(dir, name)
+	l, err = Listen("unix:" + path, nil)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	return l, path
+}
+
+// Connect the socket and returns the line sent by the helper
+func testHelperLine(t *testing.T, path string)(string) {
+	var conn net.Conn
+	var line string
+	var err error
+
+	conn, err = net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err = bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	return line
+}
+
+func Test_listenersFromEnv(t *testing.T) {
+	var listeners []*Listener
+	var err error
+
+	// Variables for another process are ignored and removed
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid() + 1))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "milter")
+	listeners, err = ListenersFromEnv()
+	if err != nil || listeners != nil {
+		t.Errorf("expect no listener for another pid, got %v %v", listeners, err)
+	}
+	if os.Getenv("LISTEN_PID") != "" || os.Getenv("LISTEN_FDS") != "" || os.Getenv("LISTEN_FDNAMES") != "" {
+		t.Errorf("expect variables removed from environment")
+	}
+
+	// No variable, no listener
+	listeners, err = ListenersFromEnv()
+	if err != nil || listeners != nil {
+		t.Errorf("expect no listener, got %v %v", listeners, err)
+	}
+
+	// Invalid count
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "two")
+	_, err = ListenersFromEnv()
+	if err == nil {
+		t.Errorf("expect error on invalid LISTEN_FDS")
+	}
+	os.Setenv("LISTEN_FDS", "-1")
+	_, err = ListenersFromEnv()
+	if err == nil {
+		t.Errorf("expect error on negative LISTEN_FDS")
+	}
+}
+
+func Test_listenersFromEnvChild(t *testing.T) {
+	var l1 *Listener
+	var l2 *Listener
+	var path1 string
+	var path2 string
+	var f1 *os.File
+	var f2 *os.File
+	var cmd *exec.Cmd
+	var line string
+	var err error
+
+	l1, path1 = testListen(t, "first.sock")
+	defer os.RemoveAll(filepath.Dir(path1))
+	defer l1.Close()
+	l2, path2 = testListen(t, "second.sock")
+	defer os.RemoveAll(filepath.Dir(path2))
+	defer l2.Close()
+	f1, err = l1.Listener.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer f1.Close()
+	f2, err = l2.Listener.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer f2.Close()
+
+	// Two file descriptors but only one name
+	cmd = exec.Command(os.Args[0], "-test.run=^Test_listenersHelper$")
+	cmd.Env = append(os.Environ(), "MILTER_TEST_HELPER=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=first")
+	cmd.ExtraFiles = []*os.File{f1, f2}
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	line = testHelperLine(t, path1)
+	if line != "first unix:" + path1 + " \n" {
+		t.Errorf("unexpected first listener %q", line)
+	}
+	line = testHelperLine(t, path2)
+	if line != " unix:" + path2 + " \n" {
+		t.Errorf("unexpected second listener %q", line)
+	}
+	err = cmd.Wait()
+	if err != nil {
+		t.Errorf("helper failed: %s", err.Error())
+	}
+}
+
+func Test_serviceUpgrade(t *testing.T) {
+	var svc *Service
+	var l *Listener
+	var path string
+	var proc *os.Process
+	var state *os.ProcessState
+	var line string
+	var err error
+
+	l, path = testListen(t, "milter.sock")
+	defer os.RemoveAll(filepath.Dir(path))
+	l.Name = "milter"
+	svc = ServiceNew(func()(ServerCallbacks) { return &testCallbacks{} })
+	svc.Listeners = append(svc.Listeners, l)
+
+	os.Setenv("MILTER_TEST_HELPER", "1")
+	proc, err = svc.Upgrade([]string{os.Args[0], "-test.run=^Test_listenersHelper$"})
+	os.Unsetenv("MILTER_TEST_HELPER")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// The socket is kept by the child after the parent shutdown
+	err = svc.Shutdown(time.Second)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	line = testHelperLine(t, path)
+	if line != "milter unix:" + path + " \n" {
+		t.Errorf("unexpected inherited listener %q", line)
+	}
+	state, err = proc.Wait()
+	if err != nil || !state.Success() {
+		t.Errorf("helper failed: %v %v", state, err)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "bufio"
+import "bytes"
+import "fmt"
+import "io"
+import "strings"
+
+// This struct contains the message rewritten by ApplyModifications. Envelope
+// is a copy of the original envelope with the recipients added and deleted.
+// Message contains the headers, the empty line and the body, with CRLF line
+// endings. If the milter asked for quarantine, Quarantined is true and
+// Quarantine contains the reason.
+type Applied struct {
+	Envelope *Envelope
+	Message []byte
+	Quarantined bool
+	Quarantine string
+}
+
+// Normalize recipient address for comparison
+func rcptKey(addr string)(string) {
+	return strings.ToLower(strings.Trim(addr, "<> "))
+}
+
+// Returns the entry of the nth occurrence of name. Like Sendmail, the
+// deleted headers are still counted, so the indexes always refer to the
+// received headers followed by the added ones, whatever the order of the
+// modifications.
+func appliedHeader(entries []*headerEntry, name string, index uint32)(*headerEntry) {
+	var e *headerEntry
+	var n uint32
+
+	for _, e = range entries {
+		if !strings.EqualFold(e.name, name) {
+			continue
+		}
+		n++
+		if n == index {
+			return e
+		}
+	}
+	return nil
+}
+
+// Apply CHGHEADER on the headers entries, returns the new entries
+func applyChgHeader(entries []*headerEntry, chg *MsgChgHeader, strict bool)([]*headerEntry, error) {
+	var e *headerEntry
+
+	e = appliedHeader(entries, chg.Name, chg.Index)
+	if e == nil {
+		if strict {
+			return nil, fmt.Errorf("CHGHEADER: no header %q at index %d", chg.Name, chg.Index)
+		}
+		// Sendmail adds the header if it doesn't exist
+		if chg.Value != "" {
+			entries = append(entries, &headerEntry{name: chg.Name, value: chg.Value})
+		}
+		return entries, nil
+	}
+	if strict && (e.deleted || e.changed) {
+		return nil, fmt.Errorf("CHGHEADER: header %q at index %d already modified", chg.Name, chg.Index)
+	}
+	if chg.Value == "" {
+		e.deleted = true
+	} else {
+		e.value = chg.Value
+		e.deleted = false
+		e.changed = true
+	}
+	return entries, nil
+}
+
+// This function applies the modifications returned by the milter at BODYEOB
+// on the envelope env and the RFC 5322 message msg, like the MTA does. The
+// modifications are applied in order:
+//
+// ▶︎ MC_ADDHEADER : the header is appended after the last header
+//
+// ▶︎ MC_CHGHEADER : the header is the 1-based occurrence Index of the name,
+// matched without case. The deleted headers are still counted, like Sendmail
+// does. An empty value deletes the header. If the header doesn't exist, it
+// is added, unless the value is empty
+//
+// ▶︎ MC_REPLBODY : the first one replaces the body, the following ones are
+// appended, because the milter sends the new body in many chunks
+//
+// ▶︎ MC_ADDRCPT / MC_DELRCPT : the recipient is added or removed. The
+// addresses are compared without case and angle brackets. Adding an
+// existing recipient or removing an unknown one is ignored
+//
+// ▶︎ MC_QUARANTINE : the message is marked as quarantined
+//
+// If strict is true, the conflicting edits return an error in place of
+// being resolved: changing or deleting a header already changed or deleted,
+// changing an absent header, adding an existing recipient, removing an
+// unknown recipient, or adding and removing the same recipient.
+func ApplyModifications(env *Envelope, msg io.Reader, mods []*Modification, strict bool)(*Applied, error) {
+	var res *Applied
+	var br *bufio.Reader
+	var headers []*MsgHeader
+	var h *MsgHeader
+	var entries []*headerEntry
+	var e *headerEntry
+	var rcpts []*MsgMail
+	var rcpt *MsgMail
+	var touched map[string]bool
+	var key string
+	var str string
+	var found int
+	var i int
+	var mod *Modification
+	var body bytes.Buffer
+	var replaced bool
+	var chg *MsgChgHeader
+	var add *MsgAddHeader
+	var ok bool
+	var out bytes.Buffer
+	var err error
+
+	br = bufio.NewReader(msg)
+	headers, err = readHeaders(br, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, h = range headers {
+		entries = append(entries, &headerEntry{name: h.Name, value: h.Value})
+	}
+	rcpts = append(rcpts, env.Rcpts...)
+	touched = make(map[string]bool)
+	res = &Applied{}
+
+	for _, mod = range mods {
+		switch mod.Modification {
+
+		case MC_ADDHEADER:
+			add, ok = mod.Value.(*MsgAddHeader)
+			if !ok {
+				return nil, fmt.Errorf("ADDHEADER: invalid value %T", mod.Value)
+			}
+			entries = append(entries, &headerEntry{name: add.Name, value: add.Value})
+
+		case MC_CHGHEADER:
+			chg, ok = mod.Value.(*MsgChgHeader)
+			if !ok {
+				return nil, fmt.Errorf("CHGHEADER: invalid value %T, header name is required", mod.Value)
+			}
+			entries, err = applyChgHeader(entries, chg, strict)
+			if err != nil {
+				return nil, err
+			}
+
+		case MC_REPLBODY:
+			if !replaced {
+				body.Reset()
+				replaced = true
+			}
+			switch v := mod.Value.(type) {
+			case []byte: body.Write(v)
+			case string: body.WriteString(v)
+			default:
+				return nil, fmt.Errorf("REPLBODY: invalid value %T", mod.Value)
+			}
+
+		case MC_ADDRCPT, MC_DELRCPT:
+			str, ok = mod.Value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: invalid value %T", mod.Modification.String(), mod.Value)
+			}
+			key = rcptKey(str)
+			if strict && touched[key] {
+				return nil, fmt.Errorf("%s: recipient %q already modified", mod.Modification.String(), str)
+			}
+			touched[key] = true
+			found = -1
+			for i, rcpt = range rcpts {
+				if rcptKey(rcpt.Address) == key {
+					found = i
+					break
+				}
+			}
+			switch {
+			case mod.Modification == MC_ADDRCPT && found < 0:
+				rcpts = append(rcpts, &MsgMail{Address: str})
+			case mod.Modification == MC_DELRCPT && found >= 0:
+				rcpts = append(rcpts[:found], rcpts[found + 1:]...)
+			case strict && found < 0:
+				return nil, fmt.Errorf("DELRCPT: unknown recipient %q", str)
+			case strict:
+				return nil, fmt.Errorf("ADDRCPT: recipient %q already exists", str)
+			}
+
+		case MC_QUARANTINE:
+			str, ok = mod.Value.(string)
+			if !ok {
+				return nil, fmt.Errorf("QUARANTINE: invalid value %T", mod.Value)
+			}
+			res.Quarantined = true
+			res.Quarantine = str
+
+		default:
+			return nil, fmt.Errorf("unexpected modification %q", mod.Modification.String())
+		}
+	}
+
+	// Build the envelope and the message
+	res.Envelope = &Envelope{
+		Connect: env.Connect,
+		Helo: env.Helo,
+		Mail: env.Mail,
+		Rcpts: rcpts,
+	}
+	headers = nil
+	for _, e = range entries {
+		if !e.deleted {
+			headers = append(headers, &MsgHeader{Name: e.name, Value: e.value})
+		}
+	}
+	writeHeaders(&out, headers, false)
+	out.WriteString("\r\n")
+	if replaced {
+		out.Write(body.Bytes())
+	} else {
+		_, err = io.Copy(&out, &crlfReader{br: br})
+		if err != nil {
+			return nil, err
+		}
+	}
+	res.Message = out.Bytes()
+	return res, nil
+}
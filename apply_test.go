@@ -0,0 +1,115 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "strings"
+import "testing"
+
+const testApplyMessage = "Received: first\n" +
+                         "Subject: hello\n" +
+                         "Received: second\n" +
+                         "Received: third\n" +
+                         "\n" +
+                         "body\n"
+
+func testApplyEnvelope()(*Envelope) {
+	return &Envelope{
+		Mail: &MsgMail{Address: "<sender@example.org>"},
+		Rcpts: []*MsgMail{&MsgMail{Address: "<a@example.net>"}, &MsgMail{Address: "<b@example.net>"}},
+	}
+}
+
+func Test_applyModifications(t *testing.T) {
+	var res *Applied
+	var rcpts []string
+	var rcpt *MsgMail
+	var err error
+
+	res, err = ApplyModifications(testApplyEnvelope(), strings.NewReader(testApplyMessage), []*Modification{
+		ModificationDelHeader(1, "received"),
+		// Deleted header is still counted
+		ModificationChgHeader(2, "Received", "changed"),
+		ModificationChgHeader(5, "Received", ""),
+		ModificationAddHeader("X-Spam", "no"),
+		ModificationDelRcpt("B@example.net"),
+		ModificationAddRcpt("<c@example.net>"),
+		ModificationQuarantine("suspect"),
+	}, false)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	if string(res.Message) != "Subject: hello\r\nReceived: changed\r\nReceived: third\r\nX-Spam: no\r\n\r\nbody\r\n" {
+		t.Errorf("unexpected message %q", string(res.Message))
+	}
+	for _, rcpt = range res.Envelope.Rcpts {
+		rcpts = append(rcpts, rcpt.Address)
+	}
+	if strings.Join(rcpts, " ") != "<a@example.net> <c@example.net>" {
+		t.Errorf("unexpected recipients %v", rcpts)
+	}
+	if !res.Quarantined || res.Quarantine != "suspect" {
+		t.Errorf("expect quarantine")
+	}
+}
+
+func Test_applyModificationsBody(t *testing.T) {
+	var res *Applied
+	var err error
+
+	res, err = ApplyModifications(testApplyEnvelope(), strings.NewReader(testApplyMessage), []*Modification{
+		ModificationReplBody([]byte("new ")),
+		ModificationReplBody([]byte("body\r\n")),
+		ModificationChgHeader(2, "Subject", "added"),
+	}, false)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !strings.HasSuffix(string(res.Message), "Subject: added\r\n\r\nnew body\r\n") {
+		t.Errorf("unexpected message %q", string(res.Message))
+	}
+}
+
+func Test_applyModificationsStrict(t *testing.T) {
+	var tests [][]*Modification
+	var mods []*Modification
+	var err error
+
+	tests = [][]*Modification{
+		{ModificationDelHeader(2, "Subject")},
+		{ModificationDelHeader(1, "Subject"), ModificationChgHeader(1, "Subject", "again")},
+		{ModificationAddRcpt("<a@example.net>")},
+		{ModificationDelRcpt("<z@example.net>")},
+		{ModificationAddRcpt("<c@example.net>"), ModificationDelRcpt("<c@example.net>")},
+		{&Modification{Modification: MC_CHGHEADER, Value: uint32(1)}},
+	}
+	for _, mods = range tests {
+		_, err = ApplyModifications(testApplyEnvelope(), strings.NewReader(testApplyMessage), mods, true)
+		if err == nil {
+			t.Errorf("expect error in strict mode for %s", mods[len(mods) - 1].Modification.String())
+		}
+	}
+
+	// Same edits are resolved without strict mode
+	for _, mods = range tests[:5] {
+		_, err = ApplyModifications(testApplyEnvelope(), strings.NewReader(testApplyMessage), mods, false)
+		if err != nil {
+			t.Errorf("unexpected error %q", err.Error())
+		}
+	}
+}
+
+func Test_applyModificationsInvalid(t *testing.T) {
+	var code ModificationCode
+	var err error
+
+	// Malformed values return error in both modes
+	for _, code = range []ModificationCode{MC_ADDHEADER, MC_CHGHEADER, MC_REPLBODY, MC_ADDRCPT, MC_DELRCPT, MC_QUARANTINE} {
+		_, err = ApplyModifications(testApplyEnvelope(), strings.NewReader(testApplyMessage), []*Modification{
+			&Modification{Modification: code, Value: 42},
+		}, false)
+		if err == nil || !strings.Contains(err.Error(), "invalid value") {
+			t.Errorf("expect invalid value error for %s, got %v", code.String(), err)
+		}
+	}
+}
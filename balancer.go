@@ -0,0 +1,221 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "fmt"
+import "sort"
+import "sync"
+import "time"
+
+// Strategy used by the Balancer to pick a milter replica
+//
+// ▶︎ LB_ROUND_ROBIN : each session uses the next replica
+//
+// ▶︎ LB_LEAST_OUTSTANDING : each session uses the replica with the fewest
+// sessions in progress
+type BalanceStrategy int
+const (
+	LB_ROUND_ROBIN BalanceStrategy = iota
+	LB_LEAST_OUTSTANDING
+)
+
+// Default backoff of the Balancer
+const (
+	DefaultBackoffMin = time.Second
+	DefaultBackoffMax = 5 * time.Minute
+)
+
+type backend struct {
+	spec string
+	outstanding int
+	failures int
+	downUntil time.Time
+}
+
+// This struct spreads the sessions on many replicas of the same milter,
+// using the connections of Pool. A replica is marked down when the
+// connection or the negotiation fails, or when a client returned with
+// Discard, failed according with its policy or saw an I/O or protocol
+// error. The replica stays down during a backoff which starts at BackoffMin
+// and doubles with each consecutive failure up to BackoffMax. Then the
+// replica is tried again, and its first success resets the backoff. If all
+// the replicas are down, they are all tried.
+type Balancer struct {
+	Strategy BalanceStrategy
+	Pool *ClientPool
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+
+	lock sync.Mutex
+	backends []*backend
+	next int
+}
+
+// Create new balancer on the replicas specs, see ParseSocketSpec. If pool
+// is nil, a pool with the default options is created.
+func BalancerNew(specs []string, pool *ClientPool)(*Balancer) {
+	var b *Balancer
+	var spec string
+
+	if pool == nil {
+		pool = ClientPoolNew(nil)
+	}
+	b = &Balancer{
+		Pool: pool,
+		BackoffMin: DefaultBackoffMin,
+		BackoffMax: DefaultBackoffMax,
+	}
+	for _, spec = range specs {
+		b.backends = append(b.backends, &backend{spec: spec})
+	}
+	return b
+}
+
+// Returns the backends to try in order, the balancer must be locked.
+func (b *Balancer)order(now time.Time)([]*backend) {
+	var list []*backend
+	var up []*backend
+	var be *backend
+	var start int
+
+	if len(b.backends) == 0 {
+		return nil
+	}
+	start = b.next % len(b.backends)
+	b.next++
+	list = append(list, b.backends[start:]...)
+	list = append(list, b.backends[:start]...)
+
+	for _, be = range list {
+		if !now.Before(be.downUntil) {
+			up = append(up, be)
+		}
+	}
+	if len(up) == 0 {
+		up = list
+	}
+	if b.Strategy == LB_LEAST_OUTSTANDING {
+		sort.SliceStable(up, func(i int, j int)(bool) {
+			return up[i].outstanding < up[j].outstanding
+		})
+	}
+	return up
+}
+
+// Returns the backend of the client
+func (b *Balancer)backend(cli *Client)(*backend) {
+	var be *backend
+
+	for _, be = range b.backends {
+		if be.spec == cli.poolSpec {
+			return be
+		}
+	}
+	return nil
+}
+
+// Mark the backend down and compute its backoff, the balancer must be
+// locked.
+func (b *Balancer)markDown(be *backend, now time.Time) {
+	var backoff time.Duration
+	var i int
+
+	be.failures++
+	backoff = b.BackoffMin
+	for i = 1; i < be.failures && backoff < b.BackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > b.BackoffMax {
+		backoff = b.BackoffMax
+	}
+	be.downUntil = now.Add(backoff)
+}
+
+// This function returns a negotiated client connected to one replica,
+// picked according with Strategy. If the connection or the negotiation
+// fails, the replica is marked down and the next one is tried, so the
+// failover is transparent before CONNECT. It returns an error only if no
+// replica is available. The client must be returned with Put, or Discard if
+// an error occurs during the session.
+func (b *Balancer)Get()(*Client, error) {
+	var list []*backend
+	var be *backend
+	var cli *Client
+	var err error
+	var lastErr error
+
+	b.lock.Lock()
+	list = b.order(time.Now())
+	b.lock.Unlock()
+
+	for _, be = range list {
+		cli, err = b.Pool.Get(be.spec)
+		if err == ErrPoolExhausted {
+			lastErr = err
+			continue
+		}
+		b.lock.Lock()
+		if err != nil {
+			b.markDown(be, time.Now())
+			b.lock.Unlock()
+			lastErr = err
+			continue
+		}
+		be.failures = 0
+		be.downUntil = time.Time{}
+		be.outstanding++
+		b.lock.Unlock()
+		return cli, nil
+	}
+	if lastErr == nil {
+		return nil, fmt.Errorf("no milter available")
+	}
+	return nil, fmt.Errorf("no milter available: %s", lastErr.Error())
+}
+
+// This function returns the client to the pool. If the client failed
+// according with its policy, or saw an I/O or protocol error, its replica
+// is marked down.
+func (b *Balancer)Put(cli *Client) {
+	var be *backend
+
+	b.lock.Lock()
+	be = b.backend(cli)
+	if be != nil {
+		be.outstanding--
+		if cli.Failure() != nil || cli.broken != nil {
+			b.markDown(be, time.Now())
+		}
+	}
+	b.lock.Unlock()
+	b.Pool.Put(cli)
+}
+
+// This function closes the client after an error and marks its replica
+// down.
+func (b *Balancer)Discard(cli *Client) {
+	var be *backend
+
+	b.lock.Lock()
+	be = b.backend(cli)
+	if be != nil {
+		be.outstanding--
+		b.markDown(be, time.Now())
+	}
+	b.lock.Unlock()
+	b.Pool.Discard(cli)
+}
+
+// Returns true if the replica spec is not marked down.
+func (b *Balancer)Up(spec string)(bool) {
+	var be *backend
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, be = range b.backends {
+		if be.spec == spec {
+			return !time.Now().Before(be.downUntil)
+		}
+	}
+	return false
+}
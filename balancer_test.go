@@ -0,0 +1,143 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "testing"
+import "time"
+
+func Test_balancerRoundRobin(t *testing.T) {
+	var b *Balancer
+	var spec1 string
+	var spec2 string
+	var stop1 func()
+	var stop2 func()
+	var conns int32
+	var bad string
+	var cli *Client
+	var used map[string]int
+	var i int
+	var err error
+
+	spec1, stop1 = testPoolService(t, &conns)
+	defer stop1()
+	spec2, stop2 = testPoolService(t, &conns)
+	defer stop2()
+	bad = "unix:/nonexistent/milter.sock"
+
+	b = BalancerNew([]string{bad, spec1, spec2}, nil)
+	defer b.Pool.Close()
+	used = make(map[string]int)
+	for i = 0; i < 6; i++ {
+		cli, err = b.Get()
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		used[cli.poolSpec]++
+		b.Put(cli)
+	}
+	if used[bad] != 0 || used[spec1] == 0 || used[spec2] == 0 {
+		t.Errorf("unexpected distribution %v", used)
+	}
+	if b.Up(bad) || !b.Up(spec1) {
+		t.Errorf("expect only the failed replica down")
+	}
+}
+
+func Test_balancerBackoff(t *testing.T) {
+	var b *Balancer
+	var spec string
+	var stop func()
+	var conns int32
+	var bad string
+	var cli *Client
+	var err error
+
+	spec, stop = testPoolService(t, &conns)
+	defer stop()
+	bad = "unix:/nonexistent/milter.sock"
+
+	b = BalancerNew([]string{bad, spec}, nil)
+	b.BackoffMin = 20 * time.Millisecond
+	defer b.Pool.Close()
+
+	cli, err = b.Get()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	b.Put(cli)
+	if b.backends[0].failures != 1 {
+		t.Fatalf("expect one failure, got %d", b.backends[0].failures)
+	}
+
+	// Passive recovery: the replica is tried again after the backoff, and
+	// the backoff doubles
+	time.Sleep(30 * time.Millisecond)
+	b.next = 0
+	cli, err = b.Get()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if b.backends[0].failures != 2 || time.Until(b.backends[0].downUntil) <= 20 * time.Millisecond {
+		t.Errorf("expect doubled backoff, got %d failures", b.backends[0].failures)
+	}
+
+	// Client discarded after an error marks its replica down
+	b.Discard(cli)
+	if b.Up(spec) {
+		t.Errorf("expect replica down after discard")
+	}
+
+	// Client returned after an I/O error marks its replica down, even
+	// without policy
+	time.Sleep(50 * time.Millisecond)
+	b.next = 1
+	cli, err = b.Get()
+	if err != nil || cli.poolSpec != spec {
+		t.Fatalf("expect client on %s, got %v", spec, err)
+	}
+	cli.buffer.Conn.SetReadDeadline(time.Now())
+	_, err = cli.ExchangeHelo("mx.example.com")
+	if err == nil {
+		t.Fatalf("expect read timeout")
+	}
+	b.Put(cli)
+	if b.Up(spec) {
+		t.Errorf("expect replica down after I/O error")
+	}
+}
+
+func Test_balancerLeastOutstanding(t *testing.T) {
+	var b *Balancer
+	var spec1 string
+	var spec2 string
+	var stop1 func()
+	var stop2 func()
+	var conns int32
+	var cli1 *Client
+	var cli2 *Client
+	var err error
+
+	spec1, stop1 = testPoolService(t, &conns)
+	defer stop1()
+	spec2, stop2 = testPoolService(t, &conns)
+	defer stop2()
+
+	b = BalancerNew([]string{spec1, spec2}, nil)
+	b.Strategy = LB_LEAST_OUTSTANDING
+	defer b.Pool.Close()
+
+	cli1, err = b.Get()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	b.next = 0
+	cli2, err = b.Get()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if cli1.poolSpec == cli2.poolSpec {
+		t.Errorf("expect sessions on both replicas")
+	}
+	b.Put(cli1)
+	b.Put(cli2)
+}
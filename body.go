@@ -0,0 +1,128 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "bytes"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+
+// Default value of BodyBuffer MemoryLimit
+const DefaultBodyMemoryLimit = 1024 * 1024
+
+// This struct configures the body accumulator of the server. Set the field
+// BodyBuffer of the Server to enable it, then the body is available in
+// OnBODYEOB using srv.Body(). Each Server needs its own BodyBuffer.
+//
+// ▶︎ MemoryLimit : the body is kept in memory up to this size, then it is
+// written in a temporary file. 0 means DefaultBodyMemoryLimit.
+//
+// ▶︎ MaxSize : hard limit of the body size. If the body exceeds this size,
+// OnBODY is not called and MaxSizeAction is returned to the MTA. 0 means no
+// limit.
+//
+// ▶︎ MaxSizeAction : action returned when MaxSize is exceeded. nil means
+// reply "552 5.3.4 Message size exceeds fixed limit".
+//
+// ▶︎ TempDir : directory of the temporary files. Empty means the default
+// directory for temporary files.
+type BodyBuffer struct {
+	MemoryLimit int64
+	MaxSize int64
+	MaxSizeAction *Action
+	TempDir string
+
+	mem bytes.Buffer
+	file *os.File
+	size int64
+}
+
+// Append body chunk. It returns false if MaxSize is exceeded.
+func (bb *BodyBuffer)write(chunk []byte)(bool, error) {
+	var limit int64
+	var err error
+
+	bb.size += int64(len(chunk))
+	if bb.MaxSize > 0 && bb.size > bb.MaxSize {
+		return false, nil
+	}
+
+	limit = bb.MemoryLimit
+	if limit == 0 {
+		limit = DefaultBodyMemoryLimit
+	}
+
+	// Spill memory buffer to disk
+	if bb.file == nil && bb.size > limit {
+		bb.file, err = ioutil.TempFile(bb.TempDir, "milter-body-")
+		if err != nil {
+			return true, err
+		}
+		_, err = bb.file.Write(bb.mem.Bytes())
+		if err != nil {
+			return true, err
+		}
+		bb.mem.Reset()
+	}
+
+	if bb.file != nil {
+		_, err = bb.file.Write(chunk)
+		return true, err
+	}
+	bb.mem.Write(chunk)
+	return true, nil
+}
+
+// Returns the action for exceeded size
+func (bb *BodyBuffer)maxSizeAction()(*Action) {
+	if bb.MaxSizeAction != nil {
+		return bb.MaxSizeAction
+	}
+	return ActionReplyCode(552, "5.3.4 Message size exceeds fixed limit")
+}
+
+// Returns reader on the accumulated body
+func (bb *BodyBuffer)reader()(io.ReadSeeker, error) {
+	var err error
+
+	if bb.file == nil {
+		return bytes.NewReader(bb.mem.Bytes()), nil
+	}
+	_, err = bb.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return bb.file, nil
+}
+
+// Returns new empty BodyBuffer with the same configuration
+func (bb *BodyBuffer)fresh()(*BodyBuffer) {
+	return &BodyBuffer{
+		MemoryLimit: bb.MemoryLimit,
+		MaxSize: bb.MaxSize,
+		MaxSizeAction: bb.MaxSizeAction,
+		TempDir: bb.TempDir,
+	}
+}
+
+// Release the memory and remove the temporary file
+func (bb *BodyBuffer)reset() {
+	if bb.file != nil {
+		bb.file.Close()
+		os.Remove(bb.file.Name())
+		bb.file = nil
+	}
+	bb.mem.Reset()
+	bb.size = 0
+}
+
+// Returns the accumulated body as io.ReadSeeker. It is valid until the
+// end of the callback OnBODYEOB. It returns error if the BodyBuffer is not
+// configured.
+func (srv *Server)Body()(io.ReadSeeker, error) {
+	if srv.BodyBuffer == nil {
+		return nil, fmt.Errorf("body buffer not enabled")
+	}
+	return srv.BodyBuffer.reader()
+}
@@ -0,0 +1,282 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "bufio"
+import "bytes"
+import "fmt"
+import "io"
+import "io/ioutil"
+
+// This struct runs the messages through many milters in order, like the
+// Postfix parameter smtpd_milters. Each Client must be connected and
+// negotiated. Each milter sees the message modified by the previous ones.
+// If Strict is true, the modifications of each milter are applied in strict
+// mode, see ApplyModifications.
+type ClientChain struct {
+	Clients []*Client
+	Strict bool
+}
+
+// This struct is returned by ClientChain.ProcessMessage. The embedded
+// Result contains the final verdict, the outcome of each recipient of the
+// original envelope, and the merged modifications of all the milters, which
+// apply on the original message. Milter is the index of the client which
+// produced the verdict. Applied contains the envelope and the message
+// modified by all the milters, it is nil if the message is stopped.
+type ChainResult struct {
+	Result
+	Milter int
+	Applied *Applied
+}
+
+// Create new chain of clients
+func ClientChainNew(clients ...*Client)(*ClientChain) {
+	return &ClientChain{Clients: clients}
+}
+
+// Record the header modifications of one milter in hs. The indexes of
+// the milter refer to the headers it received, which are the headers not
+// deleted by the previous milters, so the targets are resolved on this
+// snapshot before the changes. Like ApplyModifications, the headers deleted
+// by the same milter are still counted.
+func chainHeaders(hs *HeaderSet, mods []*Modification)(error) {
+	var snap []*headerEntry
+	var e *headerEntry
+	var target *headerEntry
+	var mod *Modification
+	var add *MsgAddHeader
+	var chg *MsgChgHeader
+	var ok bool
+
+	for _, e = range hs.entries {
+		if !e.deleted {
+			snap = append(snap, e)
+		}
+	}
+	for _, mod = range mods {
+		switch mod.Modification {
+		case MC_ADDHEADER:
+			add, ok = mod.Value.(*MsgAddHeader)
+			if !ok {
+				return fmt.Errorf("ADDHEADER: invalid value %T", mod.Value)
+			}
+			e = &headerEntry{name: add.Name, value: add.Value}
+			hs.entries = append(hs.entries, e)
+			snap = append(snap, e)
+		case MC_CHGHEADER:
+			chg, ok = mod.Value.(*MsgChgHeader)
+			if !ok {
+				return fmt.Errorf("CHGHEADER: invalid value %T, header name is required", mod.Value)
+			}
+			target = appliedHeader(snap, chg.Name, chg.Index)
+			switch {
+			case target == nil && chg.Value != "":
+				hs.entries = append(hs.entries, &headerEntry{name: chg.Name, value: chg.Value})
+			case target == nil:
+			case chg.Value == "":
+				target.deleted = true
+			default:
+				target.value = chg.Value
+				target.changed = true
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the recipient modifications which convert the recipients from to
+// the recipients to.
+func rcptModifications(from []*MsgMail, to []*MsgMail)([]*Modification) {
+	var mods []*Modification
+	var known map[string]bool
+	var kept map[string]bool
+	var rcpt *MsgMail
+
+	known = make(map[string]bool)
+	kept = make(map[string]bool)
+	for _, rcpt = range from {
+		known[rcptKey(rcpt.Address)] = true
+	}
+	for _, rcpt = range to {
+		kept[rcptKey(rcpt.Address)] = true
+		if !known[rcptKey(rcpt.Address)] {
+			mods = append(mods, ModificationAddRcpt(rcpt.Address))
+		}
+	}
+	for _, rcpt = range from {
+		if !kept[rcptKey(rcpt.Address)] {
+			mods = append(mods, ModificationDelRcpt(rcpt.Address))
+		}
+	}
+	return mods
+}
+
+// This function runs the message through each milter of the chain, see
+// Client.ProcessMessage. For each milter, the envelope contains the
+// recipients of env not rejected by the previous milters, and the message
+// contains the modifications of the previous milters. The chain stops on
+// the first REJECT, TEMPFAIL, REPLYCODE or DISCARD, or if all the recipients
+// are rejected. An ACCEPT ends the processing of the message by the milter
+// which sent it, and the next milters are called. The failures of a milter
+// are converted to its default action if its Client has a policy.
+//
+// The merged modifications contain the header changes with indexes
+// relative to the original message, the new body, the added and deleted
+// recipients and the quarantine request.
+func (cc *ClientChain)ProcessMessage(env *Envelope, msg io.Reader)(*ChainResult, error) {
+	var res *ChainResult
+	var data []byte
+	var headers []*MsgHeader
+	var hs *HeaderSet
+	var outcomes map[*MsgMail]*RcptResult
+	var rres *RcptResult
+	var accepted []*MsgMail
+	var rcpts []*MsgMail
+	var rcpt *MsgMail
+	var i int
+	var cli *Client
+	var r *Result
+	var applied *Applied
+	var mod *Modification
+	var body bytes.Buffer
+	var replaced bool
+	var bodyChanged bool
+	var quarantine *Modification
+	var reason string
+	var ok bool
+	var err error
+
+	data, err = ioutil.ReadAll(msg)
+	if err != nil {
+		return nil, err
+	}
+	headers, err = readHeaders(bufio.NewReader(bytes.NewReader(data)), false)
+	if err != nil {
+		return nil, err
+	}
+	hs = HeaderSetNew(headers)
+
+	res = &ChainResult{}
+	outcomes = make(map[*MsgMail]*RcptResult)
+	for _, rcpt = range env.Rcpts {
+		rres = &RcptResult{Rcpt: rcpt, Accepted: true}
+		outcomes[rcpt] = rres
+		res.Rcpts = append(res.Rcpts, rres)
+	}
+	rcpts = append(rcpts, env.Rcpts...)
+
+	for i, cli = range cc.Clients {
+
+		// The rejected recipients are not sent to the next milters
+		accepted = nil
+		for _, rres = range res.Rcpts {
+			if rres.Accepted {
+				accepted = append(accepted, rres.Rcpt)
+			}
+		}
+		r, err = cli.ProcessMessage(&Envelope{
+			Connect: env.Connect,
+			Helo: env.Helo,
+			Mail: env.Mail,
+			Rcpts: accepted,
+		}, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		res.Milter = i
+		res.Step = r.Step
+		res.Action = r.Action
+		for _, rres = range r.Rcpts {
+			outcomes[rres.Rcpt].Action = rres.Action
+			if rres.Accepted {
+				continue
+			}
+			outcomes[rres.Rcpt].Accepted = false
+			rcpts = removeRcpt(rcpts, rres.Rcpt.Address)
+		}
+		if actionRank(r.Action) > 0 {
+			return res, nil
+		}
+		if len(r.Modifications) == 0 {
+			continue
+		}
+
+		// Feed the modified message to the next milter
+		applied, err = ApplyModifications(&Envelope{Rcpts: rcpts}, bytes.NewReader(data), r.Modifications, cc.Strict)
+		if err != nil {
+			return nil, err
+		}
+		data = applied.Message
+		rcpts = applied.Envelope.Rcpts
+
+		// Merge the modifications. Each milter replaces the whole body.
+		err = chainHeaders(hs, r.Modifications)
+		if err != nil {
+			return nil, err
+		}
+		replaced = false
+		for _, mod = range r.Modifications {
+			switch mod.Modification {
+			case MC_REPLBODY:
+				if !replaced {
+					body.Reset()
+					replaced = true
+					bodyChanged = true
+				}
+				switch v := mod.Value.(type) {
+				case []byte: body.Write(v)
+				case string: body.WriteString(v)
+				default:
+					return nil, fmt.Errorf("REPLBODY: invalid value %T", mod.Value)
+				}
+			case MC_QUARANTINE:
+				reason, ok = mod.Value.(string)
+				if !ok {
+					return nil, fmt.Errorf("QUARANTINE: invalid value %T", mod.Value)
+				}
+				quarantine = mod
+			}
+		}
+	}
+
+	// Build the merged modifications
+	res.Modifications = hs.Modifications()
+	if bodyChanged {
+		res.Modifications = append(res.Modifications, ModificationReplBody(body.Next(BodyChunkSize)))
+		for body.Len() > 0 {
+			res.Modifications = append(res.Modifications, ModificationReplBody(body.Next(BodyChunkSize)))
+		}
+	}
+	accepted = nil
+	for _, rres = range res.Rcpts {
+		if rres.Accepted {
+			accepted = append(accepted, rres.Rcpt)
+		}
+	}
+	res.Modifications = append(res.Modifications, rcptModifications(accepted, rcpts)...)
+	res.Applied = &Applied{
+		Envelope: &Envelope{Connect: env.Connect, Helo: env.Helo, Mail: env.Mail, Rcpts: rcpts},
+		Message: data,
+	}
+	if quarantine != nil {
+		res.Modifications = append(res.Modifications, quarantine)
+		res.Applied.Quarantined = true
+		res.Applied.Quarantine = reason
+	}
+	return res, nil
+}
+
+// Remove recipient from the list
+func removeRcpt(rcpts []*MsgMail, addr string)([]*MsgMail) {
+	var out []*MsgMail
+	var rcpt *MsgMail
+
+	for _, rcpt = range rcpts {
+		if rcptKey(rcpt.Address) != rcptKey(addr) {
+			out = append(out, rcpt)
+		}
+	}
+	return out
+}
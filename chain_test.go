@@ -0,0 +1,187 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "io"
+import "io/ioutil"
+import "strings"
+import "testing"
+
+func testChainEnvelope()(*Envelope) {
+	return &Envelope{
+		Mail: &MsgMail{Address: "<sender@example.org>"},
+		Rcpts: []*MsgMail{&MsgMail{Address: "good@example.net"}, &MsgMail{Address: "bad@example.net"}},
+	}
+}
+
+const testChainMessage = "Subject: hello\n" +
+                         "From: sender@example.org\n" +
+                         "\n" +
+                         "body\n"
+
+func Test_clientChain(t *testing.T) {
+	var first *testCallbacks
+	var second *testCallbacks
+	var cli1 *Client
+	var cli2 *Client
+	var done1 func()
+	var done2 func()
+	var seen []string
+	var seenBody []byte
+	var res *ChainResult
+	var mod *Modification
+	var mods []string
+	var err error
+
+	first = &testCallbacks{}
+	first.onBODYEOB = func(srv *Server)([]*Modification, *Action, error) {
+		return []*Modification{
+			ModificationAddHeader("X-First", "yes"),
+			ModificationReplBody([]byte("new body\r\n")),
+			ModificationAddRcpt("<added@example.net>"),
+		}, ActionContinue(), nil
+	}
+	second = &testCallbacks{}
+	second.onBODYEOB = func(srv *Server)([]*Modification, *Action, error) {
+		var h *MsgHeader
+		var r io.Reader
+
+		for _, h = range srv.Transaction().Headers {
+			seen = append(seen, h.Name + "=" + h.Value)
+		}
+		r, _ = srv.Body()
+		seenBody, _ = ioutil.ReadAll(r)
+		return []*Modification{
+			ModificationAddHeader("X-Second", "yes"),
+			ModificationChgHeader(1, "X-First", "changed"),
+		}, ActionAccept(), nil
+	}
+	cli1, done1 = testPipe(t, first, nil)
+	defer done1()
+	cli2, done2 = testPipe(t, second, func(srv *Server) { srv.BodyBuffer = &BodyBuffer{} })
+	defer done2()
+
+	res, err = ClientChainNew(cli1, cli2).ProcessMessage(testChainEnvelope(), strings.NewReader(testChainMessage))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// The second milter sees the message modified by the first one
+	if strings.Join(seen, " ") != "Subject=hello From=sender@example.org X-First=yes" {
+		t.Errorf("unexpected headers seen by second milter %v", seen)
+	}
+	if string(seenBody) != "new body\r\n" {
+		t.Errorf("unexpected body seen by second milter %q", string(seenBody))
+	}
+
+	if res.Milter != 1 || res.Action.Action != AC_ACCEPT {
+		t.Errorf("expect ACCEPT from second milter, got %s from %d", res.Action.Action.String(), res.Milter)
+	}
+	for _, mod = range res.Modifications {
+		mods = append(mods, mod.Modification.String())
+	}
+	if strings.Join(mods, " ") != "ADDHEADER ADDHEADER REPLBODY ADDRCPT" {
+		t.Errorf("unexpected merged modifications %v", mods)
+	}
+	if string(res.Applied.Message) != "Subject: hello\r\nFrom: sender@example.org\r\nX-First: changed\r\nX-Second: yes\r\n\r\nnew body\r\n" {
+		t.Errorf("unexpected message %q", string(res.Applied.Message))
+	}
+	if len(res.Applied.Envelope.Rcpts) != 3 {
+		t.Errorf("expect 3 recipients, got %d", len(res.Applied.Envelope.Rcpts))
+	}
+}
+
+func Test_clientChainReject(t *testing.T) {
+	var cli1 *Client
+	var cli2 *Client
+	var done1 func()
+	var done2 func()
+	var res *ChainResult
+	var err error
+
+	cli1, done1 = testPipe(t, &testProcess{}, nil)
+	defer done1()
+	cli2, done2 = testPipe(t, &testCallbacks{rcptAction: ActionTempfail()}, nil)
+	defer done2()
+
+	res, err = ClientChainNew(cli1, cli2).ProcessMessage(testChainEnvelope(), strings.NewReader(testChainMessage))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if res.Milter != 1 || res.Step != SMFIC_RCPT || res.Action.Action != AC_TEMPFAIL || res.Applied != nil {
+		t.Errorf("expect TEMPFAIL at RCPT from second milter, got %s at %s from %d", res.Action.Action.String(), res.Step.String(), res.Milter)
+	}
+	if res.Rcpts[0].Accepted || res.Rcpts[0].Action.Action != AC_TEMPFAIL ||
+	   res.Rcpts[1].Accepted || res.Rcpts[1].Action.Action != AC_REJECT {
+		t.Errorf("unexpected recipient outcomes")
+	}
+}
+
+func Test_clientChainPolicy(t *testing.T) {
+	var failed *Client
+	var cli *Client
+	var done func()
+	var res *ChainResult
+	var err error
+
+	failed = ClientNewPolicy("unix:/nonexistent/milter.sock", &ClientPolicy{DefaultAction: DA_QUARANTINE})
+	cli, done = testPipe(t, &testCallbacks{}, nil)
+	defer done()
+
+	res, err = ClientChainNew(failed, cli).ProcessMessage(testChainEnvelope(), strings.NewReader(testChainMessage))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if res.Milter != 1 || res.Action.Action != AC_CONTINUE {
+		t.Errorf("expect CONTINUE from second milter, got %s from %d", res.Action.Action.String(), res.Milter)
+	}
+	if !res.Applied.Quarantined || len(res.Modifications) != 1 || res.Modifications[0].Modification != MC_QUARANTINE {
+		t.Errorf("expect quarantine from failed milter")
+	}
+}
+
+func Test_chainHeaders(t *testing.T) {
+	var hs *HeaderSet
+	var mod *Modification
+	var mods []string
+	var err error
+
+	hs = HeaderSetNew([]*MsgHeader{
+		&MsgHeader{Name: "Subject", Value: "hello"},
+		&MsgHeader{Name: "Received", Value: "a"},
+		&MsgHeader{Name: "Received", Value: "b"},
+	})
+	err = chainHeaders(hs, []*Modification{
+		ModificationDelHeader(1, "Received"),
+		ModificationAddHeader("X-First", "yes"),
+	})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// The second milter doesn't see the deleted header
+	err = chainHeaders(hs, []*Modification{
+		ModificationChgHeader(1, "Received", "changed"),
+		ModificationChgHeader(1, "X-First", "changed"),
+	})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	for _, mod = range hs.Modifications() {
+		mods = append(mods, mod.String())
+	}
+	if strings.Join(mods, ", ") != `CHGHEADER name="Received", index=2, value="changed", CHGHEADER name="Received", index=1, value="", ADDHEADER name="X-First", value="changed"` {
+		t.Errorf("unexpected merged modifications %s", strings.Join(mods, ", "))
+	}
+
+	// Malformed values from the milter return error
+	err = chainHeaders(hs, []*Modification{&Modification{Modification: MC_ADDHEADER, Value: "X-Bad: value"}})
+	if err == nil {
+		t.Errorf("expect error on invalid ADDHEADER value")
+	}
+	err = chainHeaders(hs, []*Modification{&Modification{Modification: MC_CHGHEADER, Value: uint32(1)}})
+	if err == nil {
+		t.Errorf("expect error on invalid CHGHEADER value")
+	}
+}
@@ -6,11 +6,31 @@ import "fmt"
 import "net"
 import "time"
 
-// this struct handle client connexion.
+// this struct handle client connexion. Logger receives the log records
+// with a level lower or equal than LogLevel. Logger is nil by default, so
+// nothing is logged. If Metrics is set, the client counts its packets and
+// the milter answer latencies in it. If AutoMacros is set, the Postfix
+// macros are filled automatically, see PostfixMacros. If Policy is set,
+// the milter failures are converted to a default action, see ClientPolicy.
 type Client struct {
 	buffer bufferIO
-	Macros []*Macro
+	Macros *MacroStore
+	Logger Logger
+	LogLevel LogLevel
 	do_close bool
+	id uint64
+	peer string
+	step MsgType
+	AutoMacros *PostfixMacros
+	Metrics *Metrics
+	since time.Time
+	taps []Tap
+	Policy *ClientPolicy
+	failure error
+	broken error
+	optNeg *MsgOptNeg
+	poolSpec string
+	idleSince time.Time
 }
 
 // This function process message as expected "Accept/reject action"
@@ -66,7 +86,7 @@ func AnswerToModification(msgType MsgType, value interface{})(*Modification, err
 	case SMFIR_CHGHEADER:
 		return &Modification{
 			Modification: ModificationCode(msgType),
-			Value: value.(*MsgChgHeader).Index,
+			Value: value.(*MsgChgHeader),
 		}, nil
 
 	default:
@@ -87,66 +107,87 @@ func AnswerToModification(msgType MsgType, value interface{})(*Modification, err
 // ▶︎ SMFIC_MAIL : i {auth_type} {auth_authen} {auth_ssf} {auth_author} {mail_mailer} {mail_host} {mail_addr}
 //
 // ▶︎ SMFIC_RCPT : {rcpt_mailer} {rcpt_host} {rcpt_addr}
+//
+// Postfix adds the following macros at each step, they are sent with
+// SMFIC_CONNECT: v {client_addr} {client_name} {client_ptr} {client_port}
+// {client_connections} {daemon_addr} {daemon_port}
 func (cli *Client)MacroAdd(step MacroStep, name string, value string)() {
-	macroAdd(&cli.Macros, step, name, value)
+	cli.Macros.Add(step, name, value)
 }
 
 // This function perform a lookup in the macro container. It returns macro value
 // or empty string if none is found
 func (cli *Client)MacroGet(name string)(MacroStep, string) {
-	return macroGet(cli.Macros, name)
+	return cli.Macros.Get(name)
 }
 
 // This function helps to debug macro container. It dumps macro content on stdout.
 func (cli *Client)MacroDebug()() {
-	macroDebug(cli.Macros)
+	cli.Macros.Debug()
 }
 
 // Add macro "_". See MacroAdd for more information.
-func (cli *Client)MacroAdd__(value string)            { macroAdd__(&cli.Macros, value) }
+func (cli *Client)MacroAdd__(value string)            { macroAdd__(cli.Macros, value) }
 // Add macro "j". See MacroAdd for more information.
-func (cli *Client)MacroAdd_j(value string)            { macroAdd_j(&cli.Macros, value) }
+func (cli *Client)MacroAdd_j(value string)            { macroAdd_j(cli.Macros, value) }
 // Add macro "{daemon_name}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_daemon_name(value string)  { macroAdd_daemon_name(&cli.Macros, value) }
+func (cli *Client)MacroAdd_daemon_name(value string)  { macroAdd_daemon_name(cli.Macros, value) }
 // Add macro "{if_name}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_if_name(value string)      { macroAdd_if_name(&cli.Macros, value) }
+func (cli *Client)MacroAdd_if_name(value string)      { macroAdd_if_name(cli.Macros, value) }
 // Add macro "{if_addr}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_if_addr(value string)      { macroAdd_if_addr(&cli.Macros, value) }
+func (cli *Client)MacroAdd_if_addr(value string)      { macroAdd_if_addr(cli.Macros, value) }
 
 // Add macro "{tls_version}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_tls_version(value string)  { macroAdd_tls_version(&cli.Macros, value) }
+func (cli *Client)MacroAdd_tls_version(value string)  { macroAdd_tls_version(cli.Macros, value) }
 // Add macro "{cipher}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_cipher(value string)       { macroAdd_cipher(&cli.Macros, value) }
+func (cli *Client)MacroAdd_cipher(value string)       { macroAdd_cipher(cli.Macros, value) }
 // Add macro "{cipher_bits}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_cipher_bits(value string)  { macroAdd_cipher_bits(&cli.Macros, value) }
+func (cli *Client)MacroAdd_cipher_bits(value string)  { macroAdd_cipher_bits(cli.Macros, value) }
 // Add macro "{cert_subject}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_cert_subject(value string) { macroAdd_cert_subject(&cli.Macros, value) }
+func (cli *Client)MacroAdd_cert_subject(value string) { macroAdd_cert_subject(cli.Macros, value) }
 // Add macro "{cert_issuer}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_cert_issuer(value string)  { macroAdd_cert_issuer(&cli.Macros, value) }
+func (cli *Client)MacroAdd_cert_issuer(value string)  { macroAdd_cert_issuer(cli.Macros, value) }
 
 // Add macro "i". See MacroAdd for more information.
-func (cli *Client)MacroAdd_i(value string)            { macroAdd_i(&cli.Macros, value) }
+func (cli *Client)MacroAdd_i(value string)            { macroAdd_i(cli.Macros, value) }
 // Add macro "{auth_type}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_auth_type(value string)    { macroAdd_auth_type(&cli.Macros, value) }
+func (cli *Client)MacroAdd_auth_type(value string)    { macroAdd_auth_type(cli.Macros, value) }
 // Add macro "{auth_authen}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_auth_authen(value string)  { macroAdd_auth_authen(&cli.Macros, value) }
+func (cli *Client)MacroAdd_auth_authen(value string)  { macroAdd_auth_authen(cli.Macros, value) }
 // Add macro "{auth_ssf}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_auth_ssf(value string)     { macroAdd_auth_ssf(&cli.Macros, value) }
+func (cli *Client)MacroAdd_auth_ssf(value string)     { macroAdd_auth_ssf(cli.Macros, value) }
 // Add macro "{auth_author}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_auth_author(value string)  { macroAdd_auth_author(&cli.Macros, value) }
+func (cli *Client)MacroAdd_auth_author(value string)  { macroAdd_auth_author(cli.Macros, value) }
 // Add macro "{mail_mailer}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_mail_mailer(value string)  { macroAdd_mail_mailer(&cli.Macros, value) }
+func (cli *Client)MacroAdd_mail_mailer(value string)  { macroAdd_mail_mailer(cli.Macros, value) }
 // Add macro "{mail_host}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_mail_host(value string)    { macroAdd_mail_host(&cli.Macros, value) }
+func (cli *Client)MacroAdd_mail_host(value string)    { macroAdd_mail_host(cli.Macros, value) }
 // Add macro "{mail_addr}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_mail_addr(value string)    { macroAdd_mail_addr(&cli.Macros, value) }
+func (cli *Client)MacroAdd_mail_addr(value string)    { macroAdd_mail_addr(cli.Macros, value) }
 
 // Add macro "{rcpt_mailer}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_rcpt_mailer(value string)  { macroAdd_rcpt_mailer(&cli.Macros, value) }
+func (cli *Client)MacroAdd_rcpt_mailer(value string)  { macroAdd_rcpt_mailer(cli.Macros, value) }
 // Add macro "{rcpt_host}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_rcpt_host(value string)    { macroAdd_rcpt_host(&cli.Macros, value) }
+func (cli *Client)MacroAdd_rcpt_host(value string)    { macroAdd_rcpt_host(cli.Macros, value) }
 // Add macro "{rcpt_addr}". See MacroAdd for more information.
-func (cli *Client)MacroAdd_rcpt_addr(value string)    { macroAdd_rcpt_addr(&cli.Macros, value) }
+func (cli *Client)MacroAdd_rcpt_addr(value string)    { macroAdd_rcpt_addr(cli.Macros, value) }
+
+// Add Postfix macro "v". See MacroAdd for more information.
+func (cli *Client)MacroAdd_v(value string)            { macroAdd_v(cli.Macros, value) }
+// Add Postfix macro "{client_addr}". See MacroAdd for more information.
+func (cli *Client)MacroAdd_client_addr(value string)  { macroAdd_client_addr(cli.Macros, value) }
+// Add Postfix macro "{client_name}". See MacroAdd for more information.
+func (cli *Client)MacroAdd_client_name(value string)  { macroAdd_client_name(cli.Macros, value) }
+// Add Postfix macro "{client_ptr}". See MacroAdd for more information.
+func (cli *Client)MacroAdd_client_ptr(value string)   { macroAdd_client_ptr(cli.Macros, value) }
+// Add Postfix macro "{client_port}". See MacroAdd for more information.
+func (cli *Client)MacroAdd_client_port(value string)  { macroAdd_client_port(cli.Macros, value) }
+// Add Postfix macro "{client_connections}". See MacroAdd for more information.
+func (cli *Client)MacroAdd_client_connections(value string) { macroAdd_client_connections(cli.Macros, value) }
+// Add Postfix macro "{daemon_addr}". See MacroAdd for more information.
+func (cli *Client)MacroAdd_daemon_addr(value string)  { macroAdd_daemon_addr(cli.Macros, value) }
+// Add Postfix macro "{daemon_port}". See MacroAdd for more information.
+func (cli *Client)MacroAdd_daemon_port(value string)  { macroAdd_daemon_port(cli.Macros, value) }
 
 // This function use connection to milter server defined in conn. It returns
 // a *Client on success and bever fails. Note, the caller must close the
@@ -156,23 +197,232 @@ func ClientNewFromConn(conn net.Conn)(*Client) {
 
 	// Create client struct
 	cli = &Client{}
+	cli.Macros = MacroStoreNew()
+	cli.id = nextConnID()
+	if conn.RemoteAddr() != nil {
+		cli.peer = conn.RemoteAddr().String()
+	}
 
 	// Declare connection
 	cli.buffer.InitBufferIO(conn)
+	cli.buffer.observer = cli
 
 	return cli
 }
 
+// Returns the unique id of this client connection. This id is reported
+// in the log records.
+func (cli *Client)ConnID()(uint64) {
+	return cli.id
+}
+
+// Register tap which receives each packet sent or received, with its
+// decoded message. Taps must be registered before the exchange starts.
+func (cli *Client)AddTap(tap Tap) {
+	cli.taps = append(cli.taps, tap)
+}
+
+// Returns the options negotiated with the milter, or nil before the
+// negotiation.
+func (cli *Client)OptNeg()(*MsgOptNeg) {
+	return cli.optNeg
+}
+
+// Returns false if the milter declined the step during the negotiation
+// using the SMFIP_NO* flags. Before the negotiation, all the steps are
+// wanted. The Exchange* functions don't send the declined steps, they
+// return CONTINUE.
+func (cli *Client)WantsStep(step MsgType)(bool) {
+	if cli.optNeg == nil {
+		return true
+	}
+	return cli.optNeg.Protocol & stepProtocolFlag(step) == 0
+}
+
+// Returns true if the milter wants the headers, so the caller could skip
+// building them.
+func (cli *Client)WantsHeaders()(bool) {
+	return cli.WantsStep(SMFIC_HEADER)
+}
+
+func (cli *Client)newLogRecord(level LogLevel)(*LogRecord) {
+	var queueID string
+
+	_, queueID = cli.MacroGet("i")
+	return &LogRecord{
+		Time: time.Now(),
+		Level: level,
+		Side: "client",
+		ConnID: cli.id,
+		Peer: cli.peer,
+		Step: cli.step,
+		QueueID: queueID,
+	}
+}
+
+// Send record to the logger if the level is enabled.
+func (cli *Client)log(level LogLevel, err error, format string, args ...interface{}) {
+	var record *LogRecord
+
+	if cli.Logger == nil || level > cli.LogLevel {
+		return
+	}
+	record = cli.newLogRecord(level)
+	record.Message = fmt.Sprintf(format, args...)
+	record.Err = err
+	cli.Logger.Log(record)
+}
+
+// Implements frameObserver
+func (cli *Client)frame(dir Direction, frame []byte) {
+	var record *LogRecord
+
+	if dir == DIR_OUT && len(frame) > 4 && toMsgType(frame[4]) != SMFIC_MACRO {
+		cli.step = toMsgType(frame[4])
+	}
+
+	if len(cli.taps) > 0 {
+		runTaps(cli.taps, "client", cli.id, dir, frame)
+	}
+
+	if cli.Metrics != nil {
+		cli.Metrics.observeFrame(dir, frame, cli.step, &cli.since)
+	}
+
+	if cli.Logger == nil || cli.LogLevel < LL_DEBUG {
+		return
+	}
+	record = cli.newLogRecord(cli.LogLevel)
+	if record.Level > LL_TRACE {
+		record.Level = LL_TRACE
+	}
+	record.Direction = dir
+	logMessage(cli.Logger, record, frame)
+}
+
+// Count protocol error in metrics and returns it
+func (cli *Client)protocolError(err error)(error) {
+	if cli.Metrics != nil {
+		cli.Metrics.protocolError()
+	}
+	return err
+}
+
+// Log error, record it and returns it. The first I/O or protocol error is
+// kept, with or without policy, the connection may be out of sync.
+func (cli *Client)fail(err error)(error) {
+	cli.log(LL_ERROR, err, "exchange failed")
+	if cli.broken == nil {
+		cli.broken = err
+	}
+	return err
+}
+
+// Returns the command of the encoded message, which could be preceded by
+// MACRO packet.
+func commandType(msg []byte)(MsgType) {
+	var frames [][]byte
+
+	frames = splitFrames(msg)
+	if len(frames) == 0 || len(frames[len(frames) - 1]) < 5 {
+		return SMFIR_ERROR
+	}
+	return toMsgType(frames[len(frames) - 1][4])
+}
+
+// Send message and wait for the answer. If an error occurs, it is logged.
+// If the policy defines a timeout for the command, it applies to the
+// whole exchange. A failed client returns its failure without sending.
+func (cli *Client)exchange(msg []byte)(MsgType, interface{}, error) {
+	if cli.failure != nil {
+		return SMFIR_ERROR, nil, cli.failure
+	}
+	if cli.armDeadline(commandType(msg)) {
+		defer cli.clearDeadline()
+	}
+	return cli.sendReceive(msg)
+}
+
+// Send message and wait for the answer, the deadline is armed by the
+// caller.
+func (cli *Client)sendReceive(msg []byte)(MsgType, interface{}, error) {
+	var msgType MsgType
+	var value interface{}
+	var err error
+
+	// Send packet
+	err = cli.buffer.Write(msg)
+	if err != nil {
+		return SMFIR_ERROR, nil, cli.fail(err)
+	}
+
+	// Read response and decode it
+	msgType, value, err = cli.ReceiveMessage()
+	if err != nil {
+		return SMFIR_ERROR, nil, cli.fail(err)
+	}
+
+	return msgType, value, nil
+}
+
+// Send message and wait for an action as answer. If the milter declined
+// the step, nothing is sent and CONTINUE is returned.
+func (cli *Client)exchangeAction(msg []byte)(*Action, error) {
+	var msgType MsgType
+	var value interface{}
+	var action *Action
+	var err error
+
+	if cli.failure == nil && !cli.WantsStep(commandType(msg)) {
+		return ActionContinue(), nil
+	}
+
+	msgType, value, err = cli.exchange(msg)
+	if err != nil {
+		return cli.failAction(commandType(msg), err)
+	}
+
+	action, err = AnswerToAction(msgType, value)
+	if err != nil {
+		return cli.failAction(commandType(msg), cli.fail(cli.protocolError(err)))
+	}
+	return action, nil
+}
+
 // This function connects to milter server using proto (like "tcp"), adress
 // (like "localhost:4567") and timeout in seconds. It returns a *Client
-// on success or fill error on error cases.
+// on success or fill error on error cases. proto could also be a milter
+// socket family ("unix", "local", "inet" or "inet6") with addr using the
+// Sendmail/Postfix syntax, like ClientNew("inet", "8891@127.0.0.1", 10). If
+// proto is empty, addr is a full socket specification. See ParseSocketSpec.
 func ClientNew(proto string, addr string, timeout int)(*Client, error) {
+	return clientDial(proto, addr, time.Duration(timeout) * time.Second)
+}
+
+// Connect to the milter server, see ClientNew
+func clientDial(proto string, addr string, timeout time.Duration)(*Client, error) {
 	var err error
 	var conn net.Conn
 	var cli *Client
+	var spec *SocketSpec
+
+	// Convert milter socket specification to Go network and address
+	switch proto {
+	case "", "unix", "local", "inet", "inet6":
+		if proto == "" {
+			spec, err = ParseSocketSpec(addr)
+		} else {
+			spec, err = ParseSocketSpec(proto + ":" + addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		proto = spec.Network()
+		addr = spec.Address()
+	}
 
 	// Open connection
-	conn, err = net.DialTimeout(proto, addr, time.Duration(timeout) * time.Second)
+	conn, err = net.DialTimeout(proto, addr, timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -186,6 +436,13 @@ func ClientNew(proto string, addr string, timeout int)(*Client, error) {
 	return cli, nil
 }
 
+// This function connects to milter server using a socket specification like
+// "unix:/var/run/milter.sock", "inet:8891@127.0.0.1" or "inet6:8891@[::1]",
+// and timeout in seconds. See ParseSocketSpec for accepted formats.
+func ClientNewSpec(spec string, timeout int)(*Client, error) {
+	return ClientNew("", spec, timeout)
+}
+
 // Terminate client connexion. The connexion ois closed if the connection
 // was established using ClientNew function, otherwise, the caller should
 // close the connexion
@@ -207,6 +464,8 @@ func (cli *Client)ReceivePacket()([]byte, error) {
 // If error is filled, the connexion should be close and processing aborted
 func (cli *Client)ReceiveMessage()(MsgType, interface{}, error) {
 	var msg []byte
+	var msgType MsgType
+	var value interface{}
 	var err error
 
 	msg, err = cli.buffer.ReceivePacket()
@@ -214,7 +473,11 @@ func (cli *Client)ReceiveMessage()(MsgType, interface{}, error) {
 		return SMFIR_ERROR, nil, err
 	}
 
-	return Decode(msg)
+	msgType, value, err = Decode(msg)
+	if err != nil {
+		return msgType, value, cli.protocolError(err)
+	}
+	return msgType, value, nil
 }
 
 // Client send message to quit milter communication. The server do not
@@ -251,25 +514,27 @@ func (cli *Client)SendMacro(step MacroStep, macros []*Macro)(error) {
 // socket are not yet supported. If an error occurs, error is filled,
 // otherwise it is nil.
 func (cli *Client)SendConnect(connect *MsgConnect)(error) {
-	return cli.buffer.Write(EncodeConnect(connect, cli.Macros))
+	cli.autoMacros(SMFIC_CONNECT, connect)
+	return cli.buffer.Write(EncodeConnect(connect, cli.Macros.All()))
 }
 
 // This function send SMTP HELO information to the milter server. HELO is just
 // one string. If an error occurs, error is filled, otherwise it is nil.
 func (cli *Client)SendHelo(helo string)(error) {
-	return cli.buffer.Write(EncodeHelo(helo, cli.Macros))
+	return cli.buffer.Write(EncodeHelo(helo, cli.Macros.All()))
 }
 
 // This function send the SMTP MAIL FROM command content. Its juste on string.
 // If an error occurs, error is filled, otherwise it is nil.
 func (cli *Client)SendMail(email *MsgMail)(error) {
-	return cli.buffer.Write(EncodeMail(email, cli.Macros))
+	cli.autoMacros(SMFIC_MAIL, nil)
+	return cli.buffer.Write(EncodeMail(email, cli.Macros.All()))
 }
 
 // This function send the SMTP RCPT TO command content. Its juste on string.
 // If an error occurs, error is filled, otherwise it is nil.
 func (cli *Client)SendRcpt(email *MsgMail)(error) {
-	return cli.buffer.Write(EncodeRcpt(email, cli.Macros))
+	return cli.buffer.Write(EncodeRcpt(email, cli.Macros.All()))
 }
 
 // The client send header contained in the email. This function should call one
@@ -305,42 +570,48 @@ func (cli *Client)SendBodyEOB()(error) {
 // closed. If the connection was establish by the caller, the caller
 // shoul close the connexion.
 func (cli *Client)ExchangeQuit()(error) {
+	if cli.failure != nil {
+		return nil
+	}
 	return cli.buffer.Write(EncodeQuit())
 }
 
 // Client send message to milter to abort current filter checks. The connection
-// is reset to the HELO state. The server do not answer anything.
+// is reset to the HELO state. The server do not answer anything. A client
+// failed according with its policy sends nothing.
 func (cli *Client)ExchangeAbort()(error) {
+	if cli.failure != nil {
+		return nil
+	}
 	return cli.buffer.Write(EncodeAbort())
 }
 
 // Client send its protocol and modifications options and get the milter server
 // requirement as return. actions is "or" between SMFIF_* constants and protocol
 // is "or" between SMFIP_* constants. The function waits for server answer.
+// If the milter fails and the client has a policy, the function returns the
+// proposed options without modification actions, and the next Exchange*
+// functions return the default action.
 func (cli *Client)ExchangeOptNeg(optNeg *MsgOptNeg)(*MsgOptNeg, error) {
-	var msg []byte
 	var err error
 	var msgType MsgType
 	var value interface{}
 
-	msg = EncodeOptNeg(optNeg)
-
-	// Send packet
-	err = cli.buffer.Write(msg)
-	if err != nil {
-		return nil, err
+	// Send packet, read response and decode
+	msgType, value, err = cli.exchange(EncodeOptNeg(optNeg))
+	if err == nil && msgType != SMFIC_OPTNEG {
+		err = cli.fail(cli.protocolError(fmt.Errorf("protocol error: expect SMFIC_OPTNEG message, got %q", msgType.String())))
 	}
-
-	// Read response and decode
-	msgType, value, err = cli.ReceiveMessage()
 	if err != nil {
-		return nil, err
-	}
-	if msgType != SMFIC_OPTNEG {
-		return nil, fmt.Errorf("protocol error: expect SMFIC_OPTNEG message, got %q", msgType.String())
+		_, err = cli.failAction(SMFIC_OPTNEG, err)
+		if err != nil {
+			return nil, err
+		}
+		return &MsgOptNeg{Version: optNeg.Version, Protocol: optNeg.Protocol}, nil
 	}
 
-	return value.(*MsgOptNeg), nil
+	cli.optNeg = value.(*MsgOptNeg)
+	return cli.optNeg, nil
 }
 
 // Client send CONNECT message which inform milter server about CONNNECT
@@ -350,108 +621,30 @@ func (cli *Client)ExchangeOptNeg(optNeg *MsgOptNeg)(*MsgOptNeg, error) {
 // occurs, error is filled, otherwise it is nil. The function waits for
 // server answer.
 func (cli *Client)ExchangeConnect(connect *MsgConnect)(*Action, error) {
-	var msg []byte
-	var msgType MsgType
-	var value interface{}
-	var err error
-
-	// Make buffer with connect payload
-	msg = EncodeConnect(connect, cli.Macros)
-
-	// Send packet
-	err = cli.buffer.Write(msg)
-	if err != nil {
-		return nil, err
-	}
-
-	// Read response and decode it
-	msgType, value, err = cli.ReceiveMessage()
-	if err != nil {
-		return nil, err
-	}
-
-	return AnswerToAction(msgType, value)
+	cli.autoMacros(SMFIC_CONNECT, connect)
+	return cli.exchangeAction(EncodeConnect(connect, cli.Macros.All()))
 }
 
 // This function send SMTP HELO information to the milter server. HELO is just
 // one string. The milter answer an *Action. If an error occurs, error is
 // filled, otherwise it is nil. The function waits for server answer.
 func (cli *Client)ExchangeHelo(helo string)(*Action, error) {
-	var msg []byte
-	var err error
-	var msgType MsgType
-	var value interface{}
-
-	// Encode message
-	msg = EncodeHelo(helo, cli.Macros)
-
-	// Send packet
-	err = cli.buffer.Write(msg)
-	if err != nil {
-		return nil, err
-	}
-
-	// Read response and decode it
-	msgType, value, err = cli.ReceiveMessage()
-	if err != nil {
-		return nil, err
-	}
-
-	return AnswerToAction(msgType, value)
+	return cli.exchangeAction(EncodeHelo(helo, cli.Macros.All()))
 }
 
 // This function send the SMTP MAIL FROM command content. Its juste on string.
 // The milter answer an *Action. If an error occurs, error is filled, otherwise
 // it is nil. The function waits for server answer.
 func (cli *Client)ExchangeMail(email *MsgMail)(*Action, error) {
-	var msg []byte
-	var err error
-	var msgType MsgType
-	var value interface{}
-
-	// encode data
-	msg = EncodeMail(email, cli.Macros)
-
-	// Send packet
-	err = cli.buffer.Write(msg)
-	if err != nil {
-		return nil, err
-	}
-
-	// Read response and decode it
-	msgType, value, err = cli.ReceiveMessage()
-	if err != nil {
-		return nil, err
-	}
-
-	return AnswerToAction(msgType, value)
+	cli.autoMacros(SMFIC_MAIL, nil)
+	return cli.exchangeAction(EncodeMail(email, cli.Macros.All()))
 }
 
 // This function send the SMTP RCPT TO command content. Its juste on string.
 // The milter answer an *Action. If an error occurs, error is filled, otherwise
 // it is nil. The function waits for server answer.
 func (cli *Client)ExchangeRcpt(email *MsgMail)(*Action, error) {
-	var msg []byte
-	var err error
-	var msgType MsgType
-	var value interface{}
-
-	// encode data
-	msg = EncodeRcpt(email, cli.Macros)
-
-	// Send packet
-	err = cli.buffer.Write(msg)
-	if err != nil {
-		return nil, err
-	}
-
-	// Read response and decode it
-	msgType, value, err = cli.ReceiveMessage()
-	if err != nil {
-		return nil, err
-	}
-
-	return AnswerToAction(msgType, value)
+	return cli.exchangeAction(EncodeRcpt(email, cli.Macros.All()))
 }
 
 // The client send header contained in the email. This function should call one
@@ -460,54 +653,14 @@ func (cli *Client)ExchangeRcpt(email *MsgMail)(*Action, error) {
 // be modified. The milter answer an *Action. If an error occurs, error is
 // filled, otherwise it is nil. The function waits for server answer.
 func (cli *Client)ExchangeHeader(hdr *MsgHeader)(*Action, error) {
-	var msg []byte
-	var err error
-	var msgType MsgType
-	var value interface{}
-
-	// Encode data
-	msg = EncodeHeader(hdr)
-
-	// Send packet
-	err = cli.buffer.Write(msg)
-	if err != nil {
-		return nil, err
-	}
-
-	// Read response and decode it
-	msgType, value, err = cli.ReceiveMessage()
-	if err != nil {
-		return nil, err
-	}
-
-	return AnswerToAction(msgType, value)
+	return cli.exchangeAction(EncodeHeader(hdr))
 }
 
 // this message indicated to the milter server the end of headers. The milter
 // answer an *Action. If an error occurs, error is filled, otherwise it is nil.
 // The function waits for server answer.
 func (cli *Client)ExchangeEOH()(*Action, error) {
-	var msg []byte
-	var err error
-	var msgType MsgType
-	var value interface{}
-
-	// encode data
-	msg = EncodeEOH()
-
-	// Send packet
-	err = cli.buffer.Write(msg)
-	if err != nil {
-		return nil, err
-	}
-
-	// Read response and decode it
-	msgType, value, err = cli.ReceiveMessage()
-	if err != nil {
-		return nil, err
-	}
-
-	return AnswerToAction(msgType, value)
+	return cli.exchangeAction(EncodeEOH())
 }
 
 // the client send to milter server the body using chunks of 65535 bytes. This
@@ -515,35 +668,16 @@ func (cli *Client)ExchangeEOH()(*Action, error) {
 // an error occurs, error is filled, otherwise it is nil. The function waits for
 // server answer.
 func (cli *Client)ExchangeBody(body []byte)(*Action, error) {
-	var msg []byte
-	var err error
-	var msgType MsgType
-	var value interface{}
-
-	// encode data
-	msg = EncodeBody(body)
-
-	// Send packet
-	err = cli.buffer.Write(msg)
-	if err != nil {
-		return nil, err
-	}
-
-	// Read response and decode it
-	msgType, value, err = cli.ReceiveMessage()
-	if err != nil {
-		return nil, err
-	}
-
-	return AnswerToAction(msgType, value)
+	return cli.exchangeAction(EncodeBody(body))
 }
 
 // This function indicated the end of body to the milter server. The server could
 // answer with a list of modification and an action. The list of modification
 // could be empty. The milter answer an *Action. If an error occurs, error is
-// filled, otherwise it is nil. The function waits for server answer.
+// filled, otherwise it is nil. The function waits for server answer. If the
+// milter fails and the client has a policy, the received modifications are
+// dropped and the default action is returned.
 func (cli *Client)ExchangeBodyEOB()([]*Modification, *Action, error) {
-	var msg []byte
 	var err error
 	var msgType MsgType
 	var value interface{}
@@ -551,31 +685,53 @@ func (cli *Client)ExchangeBodyEOB()([]*Modification, *Action, error) {
 	var action *Action
 	var modification *Modification
 
-	// encode data
-	msg = EncodeBodyEOB()
+	// The timeout applies to all the responses
+	if cli.failure != nil {
+		return cli.failBodyEOB(cli.failure)
+	}
+	if cli.armDeadline(SMFIC_BODYEOB) {
+		defer cli.clearDeadline()
+	}
 
-	// Send packet
-	err = cli.buffer.Write(msg)
+	// Send packet and read first response
+	msgType, value, err = cli.sendReceive(EncodeBodyEOB())
 	if err != nil {
-		return nil, nil, err
+		return cli.failBodyEOB(err)
 	}
 
 	// Read all responses until accept/reject action
 	for {
 
-		// Read next response and decode it
-		msgType, value, err = cli.ReceiveMessage()
-		if err != nil {
-			return nil, nil, err
-		}
-
 		// Process modification or action
 		modification, err = AnswerToModification(msgType, value)
 		if err == nil {
 			mods = append(mods, modification)
 		} else {
 			action, err = AnswerToAction(msgType, value)
-			return mods, action, err
+			if err != nil {
+				if cli.Policy != nil {
+					return cli.failBodyEOB(cli.fail(err))
+				}
+				return mods, nil, cli.fail(err)
+			}
+			return mods, action, nil
+		}
+
+		// Read next response and decode it
+		msgType, value, err = cli.ReceiveMessage()
+		if err != nil {
+			return cli.failBodyEOB(cli.fail(err))
 		}
 	}
 }
+
+// Returns the default answer to BODYEOB, or the error without policy.
+func (cli *Client)failBodyEOB(err error)([]*Modification, *Action, error) {
+	var action *Action
+
+	action, err = cli.failAction(SMFIC_BODYEOB, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cli.Policy.modifications(), action, nil
+}
@@ -0,0 +1,404 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "sort"
+import "strconv"
+import "strings"
+
+type compositeMember struct {
+	inst ServerCallbacks
+	streamer BodyStreamer // inst, if it streams the body
+	stream bodyStream
+	optNeg *MsgOptNeg // negotiated by the handler
+	connDone bool // handler accepted the connection
+	msgDone bool // handler accepted the message
+}
+
+type composite struct {
+	members []*compositeMember
+	protocol ProtocolFlag // negotiated with the MTA
+}
+
+// This function returns ServerCallbacks which dispatch each step to all the
+// handlers. It allows running several independent milters behind one socket.
+// The composite keeps state about the connection, so a new one must be
+// created for each connection, like the Service NewCallbacks does.
+//
+// ▶︎ Negotiation : each handler negotiates its own flags from the MTA offer.
+// The actions are merged with "or" and the SMFIP_NO* flags with "and", so a
+// step is skipped only if no handler wants it. The other protocol flags,
+// like SMFIP_HDR_LEADSPC, are requested if at least one handler wants them.
+// The result is limited to the flags offered by the MTA. A handler is not
+// called for the steps it declined and its modifications not negotiated are
+// dropped. The handlers which don't want SMFIP_HDR_LEADSPC receive the
+// header values without leading spaces.
+//
+// ▶︎ Verdict : the strongest action wins, REJECT / REPLYCODE over TEMPFAIL
+// over DISCARD over ACCEPT / CONTINUE. ACCEPT is returned only when all the
+// handlers accepted, otherwise the handlers which accepted are no longer
+// called until the end of the message, or the end of the connection if they
+// accepted at CONNECT or HELO step.
+//
+// ▶︎ Modifications : the BODYEOB modifications are concatenated in the
+// order of the handlers. See sortHeaderModifications for header indexes.
+// If several handlers change the same header, the change of the first one
+// is kept and the others are dropped with a warning. Only the body
+// replacement of the last handler which replaces it is kept.
+//
+// ▶︎ Body stream : the handlers implementing BodyStreamer receive the body
+// with OnBODYSTREAM, like with Exchange, and the others with OnBODY and
+// OnBODYEOB.
+func Composite(handlers ...ServerCallbacks)(ServerCallbacks) {
+	var c *composite
+	var inst ServerCallbacks
+	var m *compositeMember
+
+	c = &composite{}
+	for _, inst = range handlers {
+		m = &compositeMember{inst: inst}
+		m.streamer, _ = inst.(BodyStreamer)
+		c.members = append(c.members, m)
+	}
+	return c
+}
+
+// Returns the protocol flag which disable the step
+func stepProtocolFlag(step MsgType)(ProtocolFlag) {
+	switch step {
+	case SMFIC_CONNECT: return SMFIP_NOCONNECT
+	case SMFIC_HELO:    return SMFIP_NOHELO
+	case SMFIC_MAIL:    return SMFIP_NOMAIL
+	case SMFIC_RCPT:    return SMFIP_NORCPT
+	case SMFIC_HEADER:  return SMFIP_NOHDRS
+	case SMFIC_EOH:     return SMFIP_NOEOH
+	case SMFIC_BODY:    return SMFIP_NOBODY
+	}
+	return 0
+}
+
+// Returns the action flag required by the modification
+func modificationActionFlag(mc ModificationCode)(ActionFlag) {
+	switch mc {
+	case MC_ADDRCPT:    return SMFIF_ADDRCPT
+	case MC_DELRCPT:    return SMFIF_DELRCPT
+	case MC_REPLBODY:   return SMFIF_CHGBODY
+	case MC_ADDHEADER:  return SMFIF_ADDHDRS
+	case MC_CHGHEADER:  return SMFIF_CHGHDRS
+	case MC_QUARANTINE: return SMFIF_QUARANTINE
+	}
+	return 0
+}
+
+// Returns action precedence, greater is stronger
+func actionRank(action *Action)(int) {
+	switch action.Action {
+	case AC_REJECT, AC_REPLYCODE: return 3
+	case AC_TEMPFAIL:             return 2
+	case AC_DISCARD:              return 1
+	}
+	return 0
+}
+
+// Returns true if the member must be called for the step
+func (m *compositeMember)wants(step MsgType)(bool) {
+	if m.connDone || m.msgDone {
+		return false
+	}
+	if m.optNeg != nil && m.optNeg.Protocol & stepProtocolFlag(step) != 0 {
+		return false
+	}
+	return true
+}
+
+func (c *composite)OnOPTNEG(srv *Server, optNeg *MsgOptNeg)(*MsgOptNeg, error) {
+	var m *compositeMember
+	var offer MsgOptNeg
+	var res *MsgOptNeg
+	var merged *MsgOptNeg
+	var skip ProtocolFlag
+	var optIn ProtocolFlag
+	var err error
+
+	merged = &MsgOptNeg{Version: optNeg.Version}
+	skip = SMFIP_ALL
+	for _, m = range c.members {
+		offer = *optNeg
+		res, err = m.inst.OnOPTNEG(srv, &offer)
+		if err != nil {
+			return nil, err
+		}
+		m.optNeg = &MsgOptNeg{
+			Version: res.Version,
+			Actions: res.Actions & optNeg.Actions,
+			Protocol: res.Protocol,
+		}
+		if res.Version < merged.Version {
+			merged.Version = res.Version
+		}
+		merged.Actions |= m.optNeg.Actions
+		skip &= m.optNeg.Protocol
+		optIn |= m.optNeg.Protocol &^ SMFIP_ALL
+	}
+	merged.Protocol = (skip | optIn) & optNeg.Protocol
+	c.protocol = merged.Protocol
+	return merged, nil
+}
+
+// Dispatch step expecting action to all the members and merge the actions
+func (c *composite)dispatch(step MsgType, call func(*compositeMember)(*Action, error))(*Action, error) {
+	var m *compositeMember
+	var action *Action
+	var best *Action
+	var active int
+	var err error
+
+	for _, m = range c.members {
+		if !m.wants(step) {
+			continue
+		}
+		action, err = call(m)
+		if err != nil {
+			return nil, err
+		}
+		if action == nil {
+			action = ActionContinue()
+		}
+		if action.Action == AC_ACCEPT {
+			if step == SMFIC_CONNECT || step == SMFIC_HELO {
+				m.connDone = true
+			} else {
+				m.msgDone = true
+			}
+		}
+		if best == nil || actionRank(action) > actionRank(best) {
+			best = action
+		}
+	}
+
+	if best != nil && actionRank(best) > 0 {
+		return best, nil
+	}
+
+	// Accept only if all the handlers accepted
+	for _, m = range c.members {
+		if !m.connDone && !m.msgDone {
+			active++
+		}
+	}
+	if active == 0 {
+		return ActionAccept(), nil
+	}
+	return ActionContinue(), nil
+}
+
+// Call OnBODY, or write the chunk in the body stream
+func (m *compositeMember)body(srv *Server, body []byte)(*Action, error) {
+	if m.streamer != nil {
+		m.stream.write(srv, m.streamer, body)
+		return ActionContinue(), nil
+	}
+	return m.inst.OnBODY(srv, body)
+}
+
+// Call OnBODYEOB, or close the body stream and returns its result
+func (m *compositeMember)bodyEOB(srv *Server)([]*Modification, *Action, error) {
+	if m.streamer != nil {
+		return m.stream.end(srv, m.streamer)
+	}
+	return m.inst.OnBODYEOB(srv)
+}
+
+// Reset the message state of each member and abort the running streams
+func (c *composite)endMessage() {
+	var m *compositeMember
+
+	for _, m = range c.members {
+		m.msgDone = false
+		m.stream.abort()
+	}
+}
+
+func (c *composite)OnCONNECT(srv *Server, connect *MsgConnect)(*Action, error) {
+	return c.dispatch(SMFIC_CONNECT, func(m *compositeMember)(*Action, error) { return m.inst.OnCONNECT(srv, connect) })
+}
+
+func (c *composite)OnHELO(srv *Server, helo string)(*Action, error) {
+	return c.dispatch(SMFIC_HELO, func(m *compositeMember)(*Action, error) { return m.inst.OnHELO(srv, helo) })
+}
+
+func (c *composite)OnMAIL(srv *Server, mail *MsgMail)(*Action, error) {
+	return c.dispatch(SMFIC_MAIL, func(m *compositeMember)(*Action, error) { return m.inst.OnMAIL(srv, mail) })
+}
+
+func (c *composite)OnRCPT(srv *Server, rcpt *MsgMail)(*Action, error) {
+	return c.dispatch(SMFIC_RCPT, func(m *compositeMember)(*Action, error) { return m.inst.OnRCPT(srv, rcpt) })
+}
+
+func (c *composite)OnHEADER(srv *Server, header *MsgHeader)(*Action, error) {
+	var trimmed *MsgHeader
+
+	if c.protocol & SMFIP_HDR_LEADSPC != 0 {
+		trimmed = &MsgHeader{Name: header.Name, Value: strings.TrimLeft(header.Value, " \t")}
+	}
+	return c.dispatch(SMFIC_HEADER, func(m *compositeMember)(*Action, error) {
+		if trimmed != nil && (m.optNeg == nil || m.optNeg.Protocol & SMFIP_HDR_LEADSPC == 0) {
+			return m.inst.OnHEADER(srv, trimmed)
+		}
+		return m.inst.OnHEADER(srv, header)
+	})
+}
+
+func (c *composite)OnEOH(srv *Server)(*Action, error) {
+	return c.dispatch(SMFIC_EOH, func(m *compositeMember)(*Action, error) { return m.inst.OnEOH(srv) })
+}
+
+func (c *composite)OnBODY(srv *Server, body []byte)(*Action, error) {
+	return c.dispatch(SMFIC_BODY, func(m *compositeMember)(*Action, error) { return m.body(srv, body) })
+}
+
+func (c *composite)OnBODYEOB(srv *Server)([]*Modification, *Action, error) {
+	var mods []*Modification
+	var mod *Modification
+	var all []*Modification
+	var body []*Modification
+	var dropped []*Modification
+	var action *Action
+	var err error
+
+	defer c.endMessage()
+
+	action, err = c.dispatch(SMFIC_BODYEOB, func(m *compositeMember)(*Action, error) {
+		var action *Action
+		var err error
+		var withBody bool
+
+		mods, action, err = m.bodyEOB(srv)
+		if err != nil {
+			return nil, err
+		}
+
+		// Keep only the modifications negotiated by the handler
+		for _, mod = range mods {
+			if m.optNeg != nil && m.optNeg.Actions & modificationActionFlag(mod.Modification) == 0 {
+				srv.log(LL_WARNING, nil, "composite: drop modification %s not negotiated", mod.Modification.String())
+				continue
+			}
+			if mod.Modification == MC_REPLBODY {
+				if !withBody {
+					body = nil
+					withBody = true
+				}
+				body = append(body, mod)
+				continue
+			}
+			all = append(all, mod)
+		}
+		return action, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// No modification for terminated message
+	if actionRank(action) > 0 {
+		return nil, action, nil
+	}
+
+	all, dropped = sortHeaderModifications(all)
+	for _, mod = range dropped {
+		srv.log(LL_WARNING, nil, "composite: drop %s conflicting with a previous handler", mod.String())
+	}
+	return append(all, body...), action, nil
+}
+
+func (c *composite)OnABORT(srv *Server)(error) {
+	var m *compositeMember
+	var err error
+
+	defer c.endMessage()
+	for _, m = range c.members {
+		if m.connDone {
+			continue
+		}
+		err = m.inst.OnABORT(srv)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *composite)OnQUIT(srv *Server)(error) {
+	var m *compositeMember
+	var err error
+
+	for _, m = range c.members {
+		err = m.inst.OnQUIT(srv)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *composite)OnERROR(srv *Server, err error) {
+	var m *compositeMember
+
+	for _, m = range c.members {
+		m.inst.OnERROR(srv, err)
+	}
+}
+
+// This function orders the header modifications produced by several
+// handlers so the indexes stay consistent. The header indexes refer to the
+// original message: the changes of one header name are sorted by decreasing
+// index, so removing one header never shifts the index of the next change. If
+// several changes target the same header, the first one is kept and the
+// others are returned as dropped. The added headers are sent after the
+// changes because they are appended at the end of the header block. The other
+// modifications keep their order.
+func sortHeaderModifications(mods []*Modification)([]*Modification, []*Modification) {
+	var dropped []*Modification
+	var out []*Modification
+	var chg []*Modification
+	var add []*Modification
+	var mod *Modification
+	var seen map[string]bool
+	var key string
+	var h *MsgChgHeader
+
+	seen = make(map[string]bool)
+	for _, mod = range mods {
+		switch mod.Modification {
+		case MC_CHGHEADER:
+			h = mod.Value.(*MsgChgHeader)
+			key = strings.ToLower(h.Name) + "\x00" + strconv.FormatUint(uint64(h.Index), 10)
+			if seen[key] {
+				dropped = append(dropped, mod)
+				continue
+			}
+			seen[key] = true
+			chg = append(chg, mod)
+		case MC_ADDHEADER:
+			add = append(add, mod)
+		default:
+			out = append(out, mod)
+		}
+	}
+
+	sort.SliceStable(chg, func(i, j int)(bool) {
+		var a *MsgChgHeader
+		var b *MsgChgHeader
+
+		a = chg[i].Value.(*MsgChgHeader)
+		b = chg[j].Value.(*MsgChgHeader)
+		if !strings.EqualFold(a.Name, b.Name) {
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		}
+		return a.Index > b.Index
+	})
+
+	out = append(out, chg...)
+	return append(out, add...), dropped
+}
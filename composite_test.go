@@ -0,0 +1,128 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "strings"
+import "testing"
+
+func Test_composite(t *testing.T) {
+	var cli *Client
+	var done func()
+	var a *testCallbacks
+	var b *testCallbacks
+	var mods []*Modification
+	var action *Action
+	var h *MsgChgHeader
+	var inst ServerCallbacks
+	var srv *Server
+	var optNeg *MsgOptNeg
+	var logs []string
+
+	a = &testCallbacks{
+		onBODYEOB: func(srv *Server)([]*Modification, *Action, error) {
+			return []*Modification{
+				ModificationChgHeader(1, "Subject", "a"),
+				ModificationAddHeader("X-A", "1"),
+			}, ActionContinue(), nil
+		},
+	}
+	b = &testCallbacks{
+		actions: SMFIF_CHGHDRS,
+		onBODYEOB: func(srv *Server)([]*Modification, *Action, error) {
+			return []*Modification{
+				ModificationReplBody([]byte("not negotiated")),
+				ModificationChgHeader(2, "subject", "b"),
+				ModificationChgHeader(1, "Subject", "duplicate"),
+			}, ActionAccept(), nil
+		},
+	}
+
+	inst = Composite(a, b)
+	srv = &Server{LogLevel: LL_WARNING}
+	srv.Logger = LoggerFunc(func(r *LogRecord) { logs = append(logs, r.Message) })
+	optNeg, _ = inst.OnOPTNEG(srv, &MsgOptNeg{Version: MilterVersion, Actions: SMFIF_ALL, Protocol: SMFIP_ALL})
+	if optNeg.Actions != SMFIF_ALL || optNeg.Protocol != 0 {
+		t.Errorf("unexpected merged negotiation %s", optNeg.String())
+	}
+	mods, action, _ = inst.OnBODYEOB(srv)
+
+	if action.Action != AC_CONTINUE {
+		t.Errorf("expect CONTINUE, got %s", action.String())
+	}
+	if len(mods) != 3 {
+		t.Fatalf("expect 3 modifications, got %d", len(mods))
+	}
+	h = mods[0].Value.(*MsgChgHeader)
+	if h.Index != 2 || h.Value != "b" {
+		t.Errorf("expect Subject index 2 first, got %#v", h)
+	}
+	h = mods[1].Value.(*MsgChgHeader)
+	if h.Index != 1 || h.Value != "a" {
+		t.Errorf("expect Subject index 1 from first handler, got %#v", h)
+	}
+	if mods[2].Modification != MC_ADDHEADER {
+		t.Errorf("expect ADDHEADER last")
+	}
+	if len(logs) != 2 || logs[1] != `composite: drop CHGHEADER name="Subject", index=1, value="duplicate" conflicting with a previous handler` {
+		t.Errorf("expect conflict reported, got %q", logs)
+	}
+
+	// The strongest verdict wins
+	a.rcptAction = ActionTempfail()
+	b.rcptAction = ActionReplyCode(550, "5.7.1 no")
+	cli, done = testPipe(t, Composite(a, b), nil)
+	cli.ExchangeConnect(&MsgConnect{Hostname: "client.example", Family: SMFIA_INET, Port: 4567, Address: "192.0.2.1"})
+	cli.ExchangeMail(&MsgMail{Address: "sender@example.org"})
+	action, _ = cli.ExchangeRcpt(&MsgMail{Address: "rcpt@example.net"})
+	done()
+	if action == nil || action.Action != AC_REPLYCODE {
+		t.Errorf("expect REPLYCODE verdict")
+	}
+}
+
+// Negotiates protocol and records the received header values
+type testComposite struct {
+	testCallbacks
+	protocol ProtocolFlag
+	values []string
+}
+
+func (tc *testComposite)OnOPTNEG(srv *Server, optNeg *MsgOptNeg)(*MsgOptNeg, error) {
+	return &MsgOptNeg{Version: MilterVersion, Actions: optNeg.Actions, Protocol: tc.protocol}, nil
+}
+
+func (tc *testComposite)OnHEADER(srv *Server, hdr *MsgHeader)(*Action, error) {
+	tc.values = append(tc.values, hdr.Value)
+	return ActionContinue(), nil
+}
+
+func Test_compositeNegotiation(t *testing.T) {
+	var a *testComposite
+	var b *testComposite
+	var inst ServerCallbacks
+	var optNeg *MsgOptNeg
+	var offer *MsgOptNeg
+
+	offer = &MsgOptNeg{Version: MilterVersion, Actions: SMFIF_ALL, Protocol: SMFIP_NOHELO | SMFIP_NOBODY | SMFIP_HDR_LEADSPC}
+
+	// Without handler, only the offered steps are skipped
+	optNeg, _ = Composite().OnOPTNEG(&Server{}, offer)
+	if optNeg.Protocol != SMFIP_NOHELO | SMFIP_NOBODY {
+		t.Errorf("unexpected protocol %s", optNeg.Protocol.String())
+	}
+
+	// NO* flags are merged with "and", the leading spaces with "or"
+	a = &testComposite{protocol: SMFIP_NOHELO | SMFIP_NOBODY | SMFIP_NOEOH | SMFIP_HDR_LEADSPC}
+	b = &testComposite{protocol: SMFIP_NOHELO}
+	inst = Composite(a, b)
+	optNeg, _ = inst.OnOPTNEG(&Server{}, offer)
+	if optNeg.Protocol != SMFIP_NOHELO | SMFIP_HDR_LEADSPC {
+		t.Errorf("unexpected protocol %s", optNeg.Protocol.String())
+	}
+
+	// The handler which doesn't want the leading spaces gets them trimmed
+	inst.OnHEADER(&Server{}, &MsgHeader{Name: "Subject", Value: " hello"})
+	if strings.Join(a.values, "|") != " hello" || strings.Join(b.values, "|") != "hello" {
+		t.Errorf("unexpected header values %q %q", a.values, b.values)
+	}
+}
@@ -48,10 +48,7 @@ func (px *Proxy)OnCONNECT(srv *milter.Server, connect *milter.MsgConnect)(*milte
 	fmt.Printf("> CONNECT %s\n", connect.String())
 
 	// Dump macros
-	for _, m = range srv.Macros {
-		if m.Step != milter.MS_CONNECT {
-			continue
-		}
+	for _, m = range srv.Macros.Step(milter.MS_CONNECT) {
 		fmt.Printf("  MACRO %s\n", m.String())
 	}
 
@@ -80,10 +77,7 @@ func (px *Proxy)OnHELO(srv *milter.Server, helo string)(*milter.Action, error) {
 	fmt.Printf("> HELO %q\n", helo)
 
 	// Dump macros
-	for _, m = range srv.Macros {
-		if m.Step != milter.MS_HELO {
-			continue
-		}
+	for _, m = range srv.Macros.Step(milter.MS_HELO) {
 		fmt.Printf("  MACRO %s\n", m.String())
 	}
 
@@ -112,10 +106,7 @@ func (px *Proxy)OnMAIL(srv *milter.Server, mail *milter.MsgMail)(*milter.Action,
 	fmt.Printf("> MAIL %s\n", mail.String())
 
 	// Dump macros
-	for _, m = range srv.Macros {
-		if m.Step != milter.MS_MAIL {
-			continue
-		}
+	for _, m = range srv.Macros.Step(milter.MS_MAIL) {
 		fmt.Printf("  MACRO %s\n", m.String())
 	}
 
@@ -144,10 +135,7 @@ func (px *Proxy)OnRCPT(srv *milter.Server, mail *milter.MsgMail)(*milter.Action,
 	fmt.Printf("> RCPT %s\n", mail.String())
 
 	// Dump macros
-	for _, m = range srv.Macros {
-		if m.Step != milter.MS_RCPT {
-			continue
-		}
+	for _, m = range srv.Macros.Step(milter.MS_RCPT) {
 		fmt.Printf("  MACRO %s\n", m.String())
 	}
 
@@ -0,0 +1,779 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+
+// Test callbacks. All the steps return CONTINUE except if the
+// corresponding function or action is defined. If actions is not 0, it is
+// negotiated in place of the offered actions.
+type testCallbacks struct {
+	actions ActionFlag
+	rcptAction *Action
+	onBODYEOB func(*Server)([]*Modification, *Action, error)
+	errors []error
+}
+
+func (tc *testCallbacks)OnOPTNEG(srv *Server, optNeg *MsgOptNeg)(*MsgOptNeg, error) {
+	if tc.actions != 0 {
+		return &MsgOptNeg{Version: MilterVersion, Actions: tc.actions}, nil
+	}
+	return &MsgOptNeg{Version: MilterVersion, Actions: optNeg.Actions}, nil
+}
+func (tc *testCallbacks)OnCONNECT(srv *Server, connect *MsgConnect)(*Action, error) { return ActionContinue(), nil }
+func (tc *testCallbacks)OnHELO(srv *Server, helo string)(*Action, error)            { return ActionContinue(), nil }
+func (tc *testCallbacks)OnMAIL(srv *Server, mail *MsgMail)(*Action, error)          { return ActionContinue(), nil }
+func (tc *testCallbacks)OnRCPT(srv *Server, mail *MsgMail)(*Action, error) {
+	if tc.rcptAction != nil {
+		return tc.rcptAction, nil
+	}
+	return ActionContinue(), nil
+}
+func (tc *testCallbacks)OnHEADER(srv *Server, hdr *MsgHeader)(*Action, error)       { return ActionContinue(), nil }
+func (tc *testCallbacks)OnEOH(srv *Server)(*Action, error)                          { return ActionContinue(), nil }
+func (tc *testCallbacks)OnBODY(srv *Server, body []byte)(*Action, error)            { return ActionContinue(), nil }
+func (tc *testCallbacks)OnABORT(srv *Server)(error)                                 { return nil }
+func (tc *testCallbacks)OnQUIT(srv *Server)(error)                                  { return nil }
+func (tc *testCallbacks)OnERROR(srv *Server, err error)                             { tc.errors = append(tc.errors, err) }
+func (tc *testCallbacks)OnBODYEOB(srv *Server)([]*Modification, *Action, error) {
+	if tc.onBODYEOB != nil {
+		return tc.onBODYEOB(srv)
+	}
+	return nil, ActionContinue(), nil
+}
+
+// Start ExchangeServer on one side of a pipe and returns Client connected
+// to the other side. setup could be nil. The returned function close the
+// client and wait for the server end.
+func testPipe(t *testing.T, inst ServerCallbacks, setup func(*Server))(*Client, func()) {
+	var cConn net.Conn
+	var sConn net.Conn
+	var wg sync.WaitGroup
+	var cli *Client
+	var err error
+
+	cConn, sConn = net.Pipe()
+	wg.Add(1)
+	go func() {
+		var srv *Server
+
+		defer wg.Done()
+		srv = ServerNew(sConn)
+		if setup != nil {
+			setup(srv)
+		}
+		ExchangeServer(srv, inst)
+		sConn.Close()
+	}()
+
+	cli = ClientNewFromConn(cConn)
+	_, err = cli.ExchangeOptNeg(&MsgOptNeg{Version: MilterVersion, Actions: SMFIF_ALL})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	return cli, func() {
+		cli.ExchangeQuit()
+		wg.Wait()
+		cConn.Close()
+	}
+}
+
+// Send a simple message
+func testMessage(t *testing.T, cli *Client)([]*Modification, *Action) {
+	var mods []*Modification
+	var action *Action
+	var err error
+
+	_, err = cli.ExchangeConnect(&MsgConnect{Hostname: "client.example", Family: SMFIA_INET, Port: 4567, Address: "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	_, err = cli.ExchangeHelo("client.example")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	_, err = cli.ExchangeMail(&MsgMail{Address: "sender@example.org"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	_, err = cli.ExchangeRcpt(&MsgMail{Address: "rcpt@example.net"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	_, err = cli.ExchangeHeader(&MsgHeader{Name: "Subject", Value: "test"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	_, err = cli.ExchangeEOH()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	_, err = cli.ExchangeBody([]byte("Hello\r\n"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	mods, action, err = cli.ExchangeBodyEOB()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	return mods, action
+}
+
+func Test_exchangeLog(t *testing.T) {
+	var records []*LogRecord
+	var lock sync.Mutex
+	var cli *Client
+	var done func()
+	var r *LogRecord
+	var found bool
+	var logger Logger
+
+	logger = LoggerFunc(func(r *LogRecord) {
+		lock.Lock()
+		records = append(records, r)
+		lock.Unlock()
+	})
+
+	cli, done = testPipe(t, &testCallbacks{}, func(srv *Server) {
+		srv.Logger = logger
+		srv.LogLevel = LL_DEBUG
+	})
+	cli.MacroAdd_i("4F2A1B")
+	testMessage(t, cli)
+	done()
+
+	for _, r = range records {
+		if r.Side != "server" || r.ConnID == 0 {
+			t.Errorf("unexpected record %s", r.String())
+		}
+		if r.MsgType == SMFIC_BODYEOB && r.Direction == DIR_IN {
+			found = true
+			if r.QueueID != "4F2A1B" || r.Step != SMFIC_BODYEOB {
+				t.Errorf("expect queue id and step in record %s", r.String())
+			}
+		}
+		if r.Packet != nil {
+			t.Errorf("unexpected packet in debug record %s", r.String())
+		}
+	}
+	if !found {
+		t.Errorf("BODYEOB not logged")
+	}
+	if !strings.Contains(records[len(records)-1].Message, "closed") {
+		t.Errorf("expect connection closed as last record, got %s", records[len(records)-1].String())
+	}
+}
+
+func Test_exchangeMetrics(t *testing.T) {
+	var m *Metrics
+	var cli *Client
+	var done func()
+	var b strings.Builder
+	var s string
+	var expect string
+
+	m = MetricsNew()
+	cli, done = testPipe(t, &testCallbacks{}, func(srv *Server) {
+		srv.Metrics = m
+	})
+	testMessage(t, cli)
+	done()
+
+	if m.connections != 1 || m.messages != 1 {
+		t.Errorf("expect 1 connection and 1 message, got %d and %d", m.connections, m.messages)
+	}
+	if m.received[SMFIC_RCPT] != 1 || m.sent[SMFIR_CONTINUE] != 8 {
+		t.Errorf("unexpected counters received RCPT=%d sent CONTINUE=%d", m.received[SMFIC_RCPT], m.sent[SMFIR_CONTINUE])
+	}
+	if m.bytesIn == 0 || m.bytesOut == 0 {
+		t.Errorf("expect bytes counters")
+	}
+
+	m.WritePrometheus(&b)
+	s = b.String()
+	for _, expect = range []string{
+		"milter_connections_total 1\n",
+		"milter_received_total{type=\"HELO\"} 1\n",
+		"milter_latency_seconds_count{step=\"BODYEOB\"} 1\n",
+		"milter_latency_seconds_bucket{step=\"CONNECT\",le=\"+Inf\"} 1\n",
+	} {
+		if !strings.Contains(s, expect) {
+			t.Errorf("expect %q in:\n%s", expect, s)
+		}
+	}
+}
+
+func Test_exchangeTap(t *testing.T) {
+	var cli *Client
+	var done func()
+	var srvEvents []*TapEvent
+	var cliEvents []*TapEvent
+	var e *TapEvent
+	var found bool
+
+	cli, done = testPipe(t, &testCallbacks{}, func(srv *Server) {
+		srv.AddTap(func(e *TapEvent) {
+			srvEvents = append(srvEvents, e)
+		})
+	})
+	cli.AddTap(func(e *TapEvent) {
+		cliEvents = append(cliEvents, e)
+	})
+	testMessage(t, cli)
+	done()
+
+	// The server also see OPTNEG exchanged before the client tap registration
+	if len(srvEvents) != len(cliEvents) + 2 {
+		t.Errorf("expect %d server events, got %d", len(cliEvents) + 2, len(srvEvents))
+	}
+	for _, e = range srvEvents {
+		if e.Side != "server" || e.Err != nil || len(e.Frame) < 5 {
+			t.Errorf("unexpected event %#v", e)
+		}
+		if e.MsgType == SMFIC_MAIL && e.Direction == DIR_IN {
+			found = true
+			if e.Value.(*MsgMail).Address != "sender@example.org" {
+				t.Errorf("unexpected MAIL value %#v", e.Value)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("MAIL not seen by server tap")
+	}
+	for _, e = range cliEvents {
+		if e.Side != "client" || e.ConnID != cli.ConnID() {
+			t.Errorf("unexpected event %#v", e)
+		}
+	}
+}
+
+func Test_exchangeTransaction(t *testing.T) {
+	var cli *Client
+	var done func()
+	var inst *testCallbacks
+	var tx Transaction
+	var txp *Transaction
+	var err error
+
+	inst = &testCallbacks{
+		onBODYEOB: func(srv *Server)([]*Modification, *Action, error) {
+			txp = srv.Transaction()
+			tx = *txp
+			return nil, ActionContinue(), nil
+		},
+	}
+	cli, done = testPipe(t, inst, nil)
+	testMessage(t, cli)
+
+	// Start new message and abort it
+	_, err = cli.ExchangeMail(&MsgMail{Address: "other@example.org"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	err = cli.ExchangeAbort()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	done()
+
+	if tx.Connect == nil || tx.Connect.Address != "192.0.2.1" || tx.Helo != "client.example" {
+		t.Errorf("unexpected connection data %#v", tx)
+	}
+	if tx.Mail == nil || tx.Mail.Address != "sender@example.org" || len(tx.Rcpts) != 1 || tx.Rcpts[0].Address != "rcpt@example.net" {
+		t.Errorf("unexpected envelope %#v", tx)
+	}
+	if len(tx.Headers) != 1 || tx.Headers[0].Name != "Subject" || tx.BodySize != 7 {
+		t.Errorf("unexpected message content %#v", tx)
+	}
+	if txp.Mail != nil || txp.Rcpts != nil || txp.BodySize != 0 || txp.Helo != "client.example" {
+		t.Errorf("expect message reset and connection kept after abort %#v", txp)
+	}
+}
+
+func Test_exchangeBodyBuffer(t *testing.T) {
+	var cli *Client
+	var done func()
+	var inst *testCallbacks
+	var body []byte
+	var spilled bool
+	var action *Action
+	var err error
+
+	inst = &testCallbacks{
+		onBODYEOB: func(srv *Server)([]*Modification, *Action, error) {
+			var r io.ReadSeeker
+			var err error
+
+			spilled = srv.BodyBuffer.file != nil
+			r, err = srv.Body()
+			if err != nil {
+				return nil, nil, err
+			}
+			body, err = ioutil.ReadAll(r)
+			return nil, ActionContinue(), err
+		},
+	}
+	cli, done = testPipe(t, inst, func(srv *Server) {
+		srv.BodyBuffer = &BodyBuffer{MemoryLimit: 4}
+	})
+	testMessage(t, cli)
+	done()
+	if string(body) != "Hello\r\n" || !spilled {
+		t.Errorf("unexpected body %q, spilled=%v", body, spilled)
+	}
+
+	// Hard limit
+	cli, done = testPipe(t, inst, func(srv *Server) {
+		srv.BodyBuffer = &BodyBuffer{MaxSize: 3}
+	})
+	_, err = cli.ExchangeMail(&MsgMail{Address: "sender@example.org"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	action, err = cli.ExchangeBody([]byte("Hello\r\n"))
+	done()
+	if err != nil || action.Action != AC_REPLYCODE {
+		t.Errorf("expect REPLYCODE when body exceeds maximum size")
+	}
+}
+
+type testStreamer struct {
+	testCallbacks
+	body []byte
+}
+
+func (ts *testStreamer)OnBODYSTREAM(tx *Transaction, macros *MacroStore, body io.Reader)([]*Modification, *Action, error) {
+	var err error
+
+	ts.body, err = ioutil.ReadAll(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []*Modification{ModificationAddHeader("X-Length", fmt.Sprintf("%d", len(ts.body)))}, ActionAccept(), nil
+}
+
+func Test_exchangeBodyStream(t *testing.T) {
+	var cli *Client
+	var done func()
+	var inst *testStreamer
+	var mods []*Modification
+	var action *Action
+	var err error
+
+	inst = &testStreamer{}
+	cli, done = testPipe(t, inst, nil)
+	_, err = cli.ExchangeMail(&MsgMail{Address: "sender@example.org"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	for _, chunk := range []string{"first chunk\r\n", "Hello\r\n"} {
+		_, err = cli.ExchangeBody([]byte(chunk))
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+	mods, action, err = cli.ExchangeBodyEOB()
+	done()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	if string(inst.body) != "first chunk\r\nHello\r\n" {
+		t.Errorf("unexpected streamed body %q", inst.body)
+	}
+	if action.Action != AC_ACCEPT || len(mods) != 1 || mods[0].Value.(*MsgAddHeader).Value != "20" {
+		t.Errorf("expect streamer verdict, got %s", action.String())
+	}
+}
+
+func Test_exchangeBodyStreamChain(t *testing.T) {
+	var cli *Client
+	var done func()
+	var streamer *testStreamer
+	var other *testCallbacks
+	var steps []string
+	var record Middleware
+	var mods []*Modification
+	var action *Action
+
+	record = func(next Handler)(Handler) {
+		return func(srv *Server, step MsgType, value interface{})(*Verdict, error) {
+			var verdict *Verdict
+			var err error
+
+			verdict, err = next(srv, step, value)
+			if step == SMFIC_BODY || step == SMFIC_BODYEOB {
+				steps = append(steps, step.String() + "=" + verdict.Action.Action.String())
+			}
+			return verdict, err
+		}
+	}
+
+	// The middlewares see the body steps of the streamer
+	streamer = &testStreamer{}
+	cli, done = testPipe(t, Chain(streamer, record, TimeoutMiddleware(time.Second, ActionTempfail())), nil)
+	mods, action = testMessage(t, cli)
+	done()
+	if string(streamer.body) != "Hello\r\n" || action.Action != AC_ACCEPT || len(mods) != 1 {
+		t.Errorf("expect body streamed through chain, got %q and %s", streamer.body, action.String())
+	}
+	if strings.Join(steps, " ") != "BODY=CONTINUE BODYEOB=ACCEPT" {
+		t.Errorf("unexpected steps %v", steps)
+	}
+
+	// The streamer in composite gets the body, the other handler too
+	streamer = &testStreamer{}
+	other = &testCallbacks{}
+	cli, done = testPipe(t, Composite(Chain(streamer), other), nil)
+	mods, action = testMessage(t, cli)
+	done()
+	if string(streamer.body) != "Hello\r\n" || action.Action != AC_CONTINUE || len(mods) != 1 {
+		t.Errorf("expect body streamed through composite, got %q and %s", streamer.body, action.String())
+	}
+}
+
+type testSnapshotStreamer struct {
+	testCallbacks
+	seen []string
+}
+
+// Read the snapshot between the chunks, while Exchange receives the next
+// ones. Run with -race to check the snapshot is not shared.
+func (ts *testSnapshotStreamer)OnBODYSTREAM(tx *Transaction, macros *MacroStore, body io.Reader)([]*Modification, *Action, error) {
+	var buf [4]byte
+	var err error
+
+	for {
+		_, err = body.Read(buf[:])
+		if err == io.EOF {
+			return nil, ActionAccept(), nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		ts.seen = append(ts.seen, fmt.Sprintf("%s %s %d %d", tx.Mail.Address, macros.QueueID(), len(tx.Rcpts), tx.BodySize))
+	}
+}
+
+func Test_exchangeBodyStreamSnapshot(t *testing.T) {
+	var cli *Client
+	var done func()
+	var inst *testSnapshotStreamer
+	var action *Action
+	var seen string
+	var err error
+
+	inst = &testSnapshotStreamer{}
+	cli, done = testPipe(t, inst, nil)
+	cli.Macros.Add(MS_MAIL, "i", "4Fz1Yk0Xyz")
+	_, err = cli.ExchangeMail(&MsgMail{Address: "sender@example.org"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	_, err = cli.ExchangeRcpt(&MsgMail{Address: "rcpt@example.net"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	for _, chunk := range []string{"abcd", "efgh", "ijkl"} {
+		_, err = cli.ExchangeBody([]byte(chunk))
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+	_, action, err = cli.ExchangeBodyEOB()
+	done()
+	if err != nil || action.Action != AC_ACCEPT {
+		t.Fatalf("expect ACCEPT, got %v %v", action, err)
+	}
+	for _, seen = range inst.seen {
+		if seen != "sender@example.org 4Fz1Yk0Xyz 1 4" {
+			t.Errorf("unexpected snapshot %q", seen)
+		}
+	}
+	if len(inst.seen) != 3 {
+		t.Errorf("expect 3 reads, got %d", len(inst.seen))
+	}
+}
+
+func Test_exchangeRawMessage(t *testing.T) {
+	var cli *Client
+	var done func()
+	var inst *testCallbacks
+	var raw []byte
+	var b strings.Builder
+	var srv *Server
+	var hdr *MsgHeader
+
+	inst = &testCallbacks{
+		onBODYEOB: func(srv *Server)([]*Modification, *Action, error) {
+			var r io.Reader
+			var err error
+
+			r, err = srv.RawMessage(true)
+			if err != nil {
+				return nil, nil, err
+			}
+			raw, err = ioutil.ReadAll(r)
+			return nil, ActionContinue(), err
+		},
+	}
+	cli, done = testPipe(t, inst, func(srv *Server) {
+		srv.BodyBuffer = &BodyBuffer{}
+	})
+	cli.MacroAdd_j("mx.example.net")
+	cli.MacroAdd_i("4F2A1B")
+	testMessage(t, cli)
+	done()
+
+	if !strings.HasPrefix(string(raw), "Received: from client.example (client.example [192.0.2.1])\r\n" +
+	                                   "\tby mx.example.net with ESMTP id 4F2A1B\r\n" +
+	                                   "\tfor rcpt@example.net;\r\n\t") {
+		t.Errorf("unexpected Received header in %q", raw)
+	}
+	if !strings.HasSuffix(string(raw), ")\r\nSubject: test\r\n\r\nHello\r\n") {
+		t.Errorf("unexpected message %q", raw)
+	}
+
+	// The client without hostname is unknown, like Postfix does
+	srv = &Server{}
+	srv.transaction.record(SMFIC_CONNECT, &MsgConnect{Family: SMFIA_INET, Port: 4567, Address: "192.0.2.1"})
+	hdr = srv.receivedHeader(time.Now())
+	if !strings.HasPrefix(hdr.Value, "from unknown (unknown [192.0.2.1])\n") {
+		t.Errorf("unexpected Received header %q", hdr.Value)
+	}
+
+	// Leading spaces are kept as received and folding uses CRLF
+	writeHeaders(&b, []*MsgHeader{{Name: "X-Folded", Value: " a\n\tb"}}, true)
+	if b.String() != "X-Folded: a\r\n\tb\r\n" {
+		t.Errorf("unexpected header %q", b.String())
+	}
+}
+
+type testLifecycle struct {
+	testCallbacks
+	events []string
+}
+
+func (tl *testLifecycle)OnConnectionOpen(srv *Server)  { tl.events = append(tl.events, "open") }
+func (tl *testLifecycle)OnMessageStart(srv *Server)    { tl.events = append(tl.events, "start") }
+func (tl *testLifecycle)OnConnectionClose(srv *Server) { tl.events = append(tl.events, "close") }
+func (tl *testLifecycle)OnMessageEnd(srv *Server, reason MessageEndReason) {
+	tl.events = append(tl.events, reason.String())
+}
+
+func Test_exchangeLifecycle(t *testing.T) {
+	var cli *Client
+	var done func()
+	var inst *testLifecycle
+	var err error
+	var got string
+	var expect string
+
+	inst = &testLifecycle{}
+	cli, done = testPipe(t, Chain(Composite(inst), LogMiddleware(LL_DEBUG)), nil)
+	testMessage(t, cli)
+	_, err = cli.ExchangeMail(&MsgMail{Address: "sender@example.org"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	err = cli.ExchangeAbort()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	_, err = cli.ExchangeMail(&MsgMail{Address: "sender@example.org"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	done()
+
+	got = strings.Join(inst.events, ",")
+	expect = "open,start,accepted,start,aborted,start,disconnected,close"
+	if got != expect {
+		t.Errorf("expect events %s, got %s", expect, got)
+	}
+}
+
+func Test_exchangeLifecycleRcpt(t *testing.T) {
+	var cli *Client
+	var done func()
+	var inst *testLifecycle
+	var rcptAction *Action
+	var expect map[ActionCode]string
+	var got string
+	var err error
+
+	// ACCEPT and DISCARD at RCPT end the message, REJECT refuses only the
+	// recipient
+	expect = map[ActionCode]string{
+		AC_ACCEPT: "open,start,accepted,close",
+		AC_DISCARD: "open,start,rejected,close",
+		AC_REJECT: "open,start,disconnected,close",
+	}
+	for _, rcptAction = range []*Action{ActionAccept(), ActionDiscard(), ActionReject()} {
+		inst = &testLifecycle{}
+		inst.rcptAction = rcptAction
+		cli, done = testPipe(t, inst, nil)
+		_, err = cli.ExchangeMail(&MsgMail{Address: "sender@example.org"})
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		_, err = cli.ExchangeRcpt(&MsgMail{Address: "rcpt@example.net"})
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		done()
+		got = strings.Join(inst.events, ",")
+		if got != expect[rcptAction.Action] {
+			t.Errorf("expect events %s for %s, got %s", expect[rcptAction.Action], rcptAction.String(), got)
+		}
+	}
+}
+
+func Test_exchangeMacroScope(t *testing.T) {
+	var cli *Client
+	var done func()
+	var inst *testCallbacks
+	var seen []string
+	var err error
+
+	inst = &testCallbacks{
+		onBODYEOB: func(srv *Server)([]*Modification, *Action, error) {
+			for _, name := range []string{"{daemon_name}", "{if_name}", "i", "{rcpt_addr}"} {
+				_, value := srv.MacroGet(name)
+				seen = append(seen, value)
+			}
+			return nil, ActionContinue(), nil
+		},
+	}
+	cli, done = testPipe(t, inst, nil)
+	cli.MacroAdd_daemon_name("smtpd")
+	cli.MacroAdd_if_name("eth0")
+	cli.MacroAdd_i("QUEUE1")
+	cli.MacroAdd_rcpt_addr("rcpt@example.net")
+	testMessage(t, cli)
+
+	// Second message on the same connection, with two recipients
+	cli.MacroAdd_i("QUEUE2")
+	_, err = cli.ExchangeMail(&MsgMail{Address: "sender@example.org"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	for _, rcpt := range []string{"first@example.net", "second@example.net"} {
+		cli.MacroAdd_rcpt_addr(rcpt)
+		_, err = cli.ExchangeRcpt(&MsgMail{Address: rcpt})
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+	_, _, err = cli.ExchangeBodyEOB()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	done()
+
+	if strings.Join(seen, ",") != "smtpd,eth0,QUEUE1,rcpt@example.net,smtpd,eth0,QUEUE2,second@example.net" {
+		t.Errorf("unexpected macros %v", seen)
+	}
+}
+
+func Test_exchangePostfixMacros(t *testing.T) {
+	var cli *Client
+	var done func()
+	var inst *testCallbacks
+	var macros *MacroStore
+
+	inst = &testCallbacks{
+		onBODYEOB: func(srv *Server)([]*Modification, *Action, error) {
+			macros = &MacroStore{}
+			for _, m := range srv.Macros.All() {
+				macros.Add(m.Step, m.Name, m.Value)
+			}
+			return nil, ActionContinue(), nil
+		},
+	}
+	cli, done = testPipe(t, inst, nil)
+	cli.AutoMacros = &PostfixMacros{
+		Local: &net.TCPAddr{IP: net.ParseIP("198.51.100.25"), Port: 25},
+		Auth: &MacroAuth{Type: "PLAIN", Authen: "alice"},
+	}
+	cli.MacroAdd_tls_version("TLSv1.3")
+	testMessage(t, cli)
+	done()
+
+	for name, expect := range map[string]string{
+		"_": "client.example [192.0.2.1]",
+		"{client_addr}": "192.0.2.1",
+		"{client_name}": "client.example",
+		"{client_port}": "4567",
+		"{daemon_addr}": "198.51.100.25",
+		"{daemon_port}": "25",
+		"{auth_type}": "PLAIN",
+		"{auth_authen}": "alice",
+		"{tls_version}": "TLSv1.3",
+	} {
+		value, _ := macros.Lookup(name)
+		if value != expect {
+			t.Errorf("expect macro %s=%q, got %q", name, expect, value)
+		}
+	}
+	if macros.ClientPort() != 4567 || macros.AuthUser() != "alice" {
+		t.Errorf("unexpected typed accessors")
+	}
+}
+
+// Declines HELO, headers and body, and counts the received steps
+type testDeclined struct {
+	testCallbacks
+	steps []string
+}
+
+func (td *testDeclined)OnOPTNEG(srv *Server, optNeg *MsgOptNeg)(*MsgOptNeg, error) {
+	return &MsgOptNeg{Version: MilterVersion, Protocol: SMFIP_NOHELO | SMFIP_NOHDRS | SMFIP_NOBODY}, nil
+}
+func (td *testDeclined)OnHELO(srv *Server, helo string)(*Action, error) {
+	td.steps = append(td.steps, "helo")
+	return ActionContinue(), nil
+}
+func (td *testDeclined)OnHEADER(srv *Server, hdr *MsgHeader)(*Action, error) {
+	td.steps = append(td.steps, "header")
+	return ActionContinue(), nil
+}
+func (td *testDeclined)OnBODY(srv *Server, body []byte)(*Action, error) {
+	td.steps = append(td.steps, "body")
+	return ActionContinue(), nil
+}
+func (td *testDeclined)OnEOH(srv *Server)(*Action, error) {
+	td.steps = append(td.steps, "eoh")
+	return ActionContinue(), nil
+}
+
+func Test_exchangeDeclinedSteps(t *testing.T) {
+	var td *testDeclined
+	var cli *Client
+	var done func()
+	var action *Action
+
+	td = &testDeclined{}
+	cli, done = testPipe(t, td, nil)
+
+	if cli.OptNeg() == nil || cli.WantsHeaders() || !cli.WantsStep(SMFIC_EOH) {
+		t.Errorf("expect negotiated options without headers, got %v", cli.OptNeg())
+	}
+	_, action = testMessage(t, cli)
+	if action.Action != AC_CONTINUE {
+		t.Errorf("expect CONTINUE, got %s", action.Action.String())
+	}
+	done()
+
+	if strings.Join(td.steps, " ") != "eoh" {
+		t.Errorf("expect only EOH, got %v", td.steps)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "path"
+import "strings"
+
+type headerEntry struct {
+	name string
+	value string
+	index uint32 // occurrence of the name in the received headers, 0 for added header
+	deleted bool
+	changed bool
+	moved bool // received header which must be deleted and added again
+}
+
+// This struct contains the message headers and records the operations done
+// on them. The function Modifications converts the operations to CHGHEADER
+// and ADDHEADER modifications with the right indexes. The CHGHEADER index is
+// the 1-based occurrence of the header name in the received headers, so the
+// handler doesn't compute it. The names are matched without case. The
+// occurrence n used by the operations is 1-based and counts only the headers
+// not deleted, in the current order.
+//
+// The protocol version 2 can't insert header, so inserting header before an
+// existing one deletes the following headers and adds them again after the
+// new one.
+type HeaderSet struct {
+	entries []*headerEntry
+}
+
+// Create new HeaderSet from the headers received by the server
+func HeaderSetNew(headers []*MsgHeader)(*HeaderSet) {
+	var hs *HeaderSet
+	var h *MsgHeader
+	var count map[string]uint32
+	var key string
+
+	hs = &HeaderSet{}
+	count = make(map[string]uint32)
+	for _, h = range headers {
+		key = strings.ToLower(h.Name)
+		count[key]++
+		hs.entries = append(hs.entries, &headerEntry{
+			name: h.Name,
+			value: h.Value,
+			index: count[key],
+		})
+	}
+	return hs
+}
+
+// Returns new HeaderSet filled with the headers of the current message.
+func (srv *Server)HeaderSet()(*HeaderSet) {
+	return HeaderSetNew(srv.transaction.Headers)
+}
+
+// Returns the position in the entries of the nth occurrence of name, or -1
+func (hs *HeaderSet)find(name string, n int)(int) {
+	var i int
+	var e *headerEntry
+
+	for i, e = range hs.entries {
+		if e.deleted || !strings.EqualFold(e.name, name) {
+			continue
+		}
+		n--
+		if n == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the values of the header name, in order.
+func (hs *HeaderSet)Get(name string)([]string) {
+	var values []string
+	var e *headerEntry
+
+	for _, e = range hs.entries {
+		if !e.deleted && strings.EqualFold(e.name, name) {
+			values = append(values, e.value)
+		}
+	}
+	return values
+}
+
+// Returns the current headers, in order.
+func (hs *HeaderSet)Headers()([]*MsgHeader) {
+	var headers []*MsgHeader
+	var e *headerEntry
+
+	for _, e = range hs.entries {
+		if !e.deleted {
+			headers = append(headers, &MsgHeader{Name: e.name, Value: e.value})
+		}
+	}
+	return headers
+}
+
+// Delete all the occurrences of the header name. It returns the number of
+// deleted headers.
+func (hs *HeaderSet)Delete(name string)(int) {
+	var e *headerEntry
+	var n int
+
+	for _, e = range hs.entries {
+		if !e.deleted && strings.EqualFold(e.name, name) {
+			e.deleted = true
+			n++
+		}
+	}
+	return n
+}
+
+// Delete all the headers whose name matches the glob pattern, like
+// "X-Spam-*". See path.Match for the syntax. It returns the number of deleted
+// headers.
+func (hs *HeaderSet)DeleteMatch(pattern string)(int) {
+	var e *headerEntry
+	var n int
+	var ok bool
+
+	pattern = strings.ToLower(pattern)
+	for _, e = range hs.entries {
+		if e.deleted {
+			continue
+		}
+		ok, _ = path.Match(pattern, strings.ToLower(e.name))
+		if ok {
+			e.deleted = true
+			n++
+		}
+	}
+	return n
+}
+
+// Delete the nth occurrence of the header name. It returns false if the
+// header doesn't exists.
+func (hs *HeaderSet)DeleteNth(name string, n int)(bool) {
+	var i int
+
+	i = hs.find(name, n)
+	if i < 0 {
+		return false
+	}
+	hs.entries[i].deleted = true
+	return true
+}
+
+// Replace the value of the nth occurrence of the header name. It returns
+// false if the header doesn't exists.
+func (hs *HeaderSet)Replace(name string, n int, value string)(bool) {
+	var i int
+
+	i = hs.find(name, n)
+	if i < 0 {
+		return false
+	}
+	hs.entries[i].value = value
+	hs.entries[i].changed = true
+	return true
+}
+
+// Add header at the end of the headers.
+func (hs *HeaderSet)Add(name string, value string) {
+	hs.entries = append(hs.entries, &headerEntry{name: name, value: value})
+}
+
+// Insert header before the nth occurrence of the header before. It returns
+// false if the header before doesn't exists.
+func (hs *HeaderSet)InsertBefore(before string, n int, name string, value string)(bool) {
+	var i int
+	var e *headerEntry
+	var entries []*headerEntry
+
+	i = hs.find(before, n)
+	if i < 0 {
+		return false
+	}
+
+	// The following received headers must be moved after the new one
+	for _, e = range hs.entries[i:] {
+		if e.index != 0 {
+			e.moved = true
+		}
+	}
+
+	entries = append(entries, hs.entries[:i]...)
+	entries = append(entries, &headerEntry{name: name, value: value})
+	entries = append(entries, hs.entries[i:]...)
+	hs.entries = entries
+	return true
+}
+
+// Returns the modifications which apply the operations on the message. The
+// changes are sorted with decreasing index for each name, then the added
+// headers follow in order.
+func (hs *HeaderSet)Modifications()([]*Modification) {
+	var mods []*Modification
+	var adds []*Modification
+	var e *headerEntry
+
+	for _, e = range hs.entries {
+		if e.index != 0 {
+			switch {
+			case e.deleted || e.moved:
+				mods = append(mods, ModificationDelHeader(e.index, e.name))
+			case e.changed:
+				mods = append(mods, ModificationChgHeader(e.index, e.name, e.value))
+			}
+		}
+		if !e.deleted && (e.index == 0 || e.moved) {
+			adds = append(adds, ModificationAddHeader(e.name, e.value))
+		}
+	}
+
+	mods, _ = sortHeaderModifications(mods)
+	return append(mods, adds...)
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "fmt"
+import "strings"
+import "testing"
+
+func modsString(mods []*Modification)(string) {
+	var list []string
+	var mod *Modification
+
+	for _, mod = range mods {
+		switch v := mod.Value.(type) {
+		case *MsgChgHeader: list = append(list, fmt.Sprintf("chg %s[%d]=%q", v.Name, v.Index, v.Value))
+		case *MsgAddHeader: list = append(list, fmt.Sprintf("add %s=%q", v.Name, v.Value))
+		}
+	}
+	return strings.Join(list, "; ")
+}
+
+func Test_headerSet(t *testing.T) {
+	var hs *HeaderSet
+	var headers []*MsgHeader
+	var got string
+	var expect string
+
+	headers = []*MsgHeader{
+		{Name: "Received", Value: "from a"},
+		{Name: "X-Spam-Score", Value: "5"},
+		{Name: "received", Value: "from b"},
+		{Name: "Subject", Value: "test"},
+		{Name: "X-SPAM-Flag", Value: "YES"},
+		{Name: "Received", Value: "from c"},
+	}
+
+	// Delete and replace
+	hs = HeaderSetNew(headers)
+	if hs.DeleteMatch("x-spam-*") != 2 {
+		t.Errorf("expect 2 deleted headers")
+	}
+	hs.DeleteNth("Received", 1)
+	hs.Replace("RECEIVED", 1, "from B") // now the first visible is the original second
+	hs.Add("X-Scanned", "yes")
+	got = modsString(hs.Modifications())
+	expect = `chg received[2]="from B"; chg Received[1]=""; chg X-SPAM-Flag[1]=""; chg X-Spam-Score[1]=""; add X-Scanned="yes"`
+	if got != expect {
+		t.Errorf("expect %s\ngot    %s", expect, got)
+	}
+
+	// Insert moves the following headers
+	hs = HeaderSetNew(headers)
+	hs.Delete("x-spam-score")
+	if !hs.InsertBefore("Subject", 1, "X-Before", "1") {
+		t.Errorf("expect Subject found")
+	}
+	got = modsString(hs.Modifications())
+	expect = `chg Received[3]=""; chg Subject[1]=""; chg X-SPAM-Flag[1]=""; chg X-Spam-Score[1]=""; ` +
+	         `add X-Before="1"; add Subject="test"; add X-SPAM-Flag="YES"; add Received="from c"`
+	if got != expect {
+		t.Errorf("expect %s\ngot    %s", expect, got)
+	}
+	if len(hs.Get("received")) != 3 || len(hs.Headers()) != 6 {
+		t.Errorf("unexpected headers %v", hs.Headers())
+	}
+}
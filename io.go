@@ -3,11 +3,54 @@
 package milter
 
 import "bufio"
+import "encoding/binary"
+import "errors"
 import "net"
 
+// Returned by the I/O functions when the connection was not established
+var errNotConnected = errors.New("not connected")
+
+// Define direction of a message relative to the local side.
+type Direction int
+const (
+	DIR_IN Direction = iota
+	DIR_OUT
+)
+
+// Display Direction as string for debug purpose
+func (d *Direction)String()(string) {
+	if *d == DIR_OUT {
+		return "send"
+	}
+	return "receive"
+}
+
+// Client and Server implements this interface to observe each packet
+// exchanged. frame contains the full packet, including length.
+type frameObserver interface {
+	frame(dir Direction, frame []byte)
+}
+
 type bufferIO struct {
 	Conn net.Conn
 	Reader *bufio.Reader
+	observer frameObserver
+}
+
+// Split buffer which contains one or more encoded packets.
+func splitFrames(data []byte)([][]byte) {
+	var frames [][]byte
+	var length int
+
+	for len(data) >= 4 {
+		length = int(binary.BigEndian.Uint32(data)) + 4
+		if length > len(data) {
+			length = len(data)
+		}
+		frames = append(frames, data[:length])
+		data = data[length:]
+	}
+	return frames
 }
 
 func (b *bufferIO)InitBufferIO(conn net.Conn) {
@@ -16,6 +59,9 @@ func (b *bufferIO)InitBufferIO(conn net.Conn) {
 }
 
 func (b *bufferIO)Close()(error) {
+	if b.Conn == nil {
+		return nil
+	}
 	return b.Conn.Close()
 }
 
@@ -24,7 +70,13 @@ func (b *bufferIO)Close()(error) {
 func (b *bufferIO)Write(data []byte)(error) {
 	var err error
 	var length int
+	var frame []byte
+	var sent []byte
 
+	if b.Conn == nil {
+		return errNotConnected
+	}
+	sent = data
 	for {
 		length, err = b.Conn.Write(data)
 		if err != nil {
@@ -34,8 +86,15 @@ func (b *bufferIO)Write(data []byte)(error) {
 		if len(data) > 0 {
 			continue
 		}
-		return nil
+		break
+	}
+
+	if b.observer != nil {
+		for _, frame = range splitFrames(sent) {
+			b.observer.frame(DIR_OUT, frame)
+		}
 	}
+	return nil
 }
 
 // this function read the required length in buffer "want" and return
@@ -46,6 +105,9 @@ func (b *bufferIO)Read(want []byte)(error) {
 	var err error
 	var l int
 
+	if b.Reader == nil {
+		return errNotConnected
+	}
 	for {
 		l, err = b.Reader.Read(want[current_length:])
 		if l > 0 {
@@ -66,6 +128,7 @@ func (b *bufferIO)Read(want []byte)(error) {
 func (b *bufferIO)ReceivePacket()([]byte, error) {
 	var length uint
 	var msg []byte
+	var head []byte
 	var err error
 
 	// Read data as long as we have full message
@@ -73,12 +136,12 @@ func (b *bufferIO)ReceivePacket()([]byte, error) {
 
 		// decode message length and check avalaible length. If no
 		// sufficient data, try again read network
-		msg = make([]byte, 4)
-		err = b.Read(msg)
+		head = make([]byte, 4)
+		err = b.Read(head)
 		if err != nil {
 			return nil, err
 		}
-		length, err = DecodeLength(msg)
+		length, err = DecodeLength(head)
 		if err != nil {
 			return nil, err
 		}
@@ -90,6 +153,10 @@ func (b *bufferIO)ReceivePacket()([]byte, error) {
 			return nil, err
 		}
 
+		if b.observer != nil {
+			b.observer.frame(DIR_IN, append(head, msg...))
+		}
+
 		// Special case, if the message is SMFIR_PROGRESS, ignore it
 		// and read again. This message is designed to retrigger timeout
 		// during long process
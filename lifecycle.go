@@ -0,0 +1,166 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "fmt"
+
+// Reason of the end of message
+//
+// ▶︎ ME_ACCEPTED : the milter answered ACCEPT or CONTINUE at BODYEOB, or
+// ACCEPT during the message, RCPT included
+//
+// ▶︎ ME_REJECTED : the milter answered REJECT, TEMPFAIL, REPLYCODE or
+// DISCARD during the message. At RCPT, only DISCARD ends the message, the
+// other answers refuse only the recipient
+//
+// ▶︎ ME_ABORTED : the MTA sent ABORT, or started a new message
+//
+// ▶︎ ME_DISCONNECTED : the connection was closed during the message
+type MessageEndReason int
+const (
+	ME_ACCEPTED MessageEndReason = iota
+	ME_REJECTED
+	ME_ABORTED
+	ME_DISCONNECTED
+)
+
+// Display MessageEndReason as string for debug purpose
+func (r *MessageEndReason)String()(string) {
+	switch *r {
+	case ME_ACCEPTED:     return "accepted"
+	case ME_REJECTED:     return "rejected"
+	case ME_ABORTED:      return "aborted"
+	case ME_DISCONNECTED: return "disconnected"
+	}
+	return fmt.Sprintf("reason[%d]", int(*r))
+}
+
+// Optional interface of ServerCallbacks. If the callbacks implement it,
+// Exchange calls these functions on the connection and message boundaries.
+// OnConnectionOpen is called before the first message is read and
+// OnConnectionClose is always called when Exchange returns, whatever the
+// cause. OnMessageStart is called when MAIL is received, before OnMAIL.
+// OnMessageEnd is called once for each started message. Chain and Composite
+// forward these calls.
+type LifecycleCallbacks interface {
+	OnConnectionOpen(*Server)
+	OnMessageStart(*Server)
+	OnMessageEnd(*Server, MessageEndReason)
+	OnConnectionClose(*Server)
+}
+
+type lifecycle struct {
+	hooks LifecycleCallbacks
+	inMessage bool
+}
+
+func (l *lifecycle)connectionOpen(srv *Server) {
+	if l.hooks != nil {
+		l.hooks.OnConnectionOpen(srv)
+	}
+}
+
+func (l *lifecycle)messageStart(srv *Server) {
+	if l.inMessage {
+		l.messageEnd(srv, ME_ABORTED)
+	}
+	l.inMessage = true
+	if l.hooks != nil {
+		l.hooks.OnMessageStart(srv)
+	}
+}
+
+func (l *lifecycle)messageEnd(srv *Server, reason MessageEndReason) {
+	if !l.inMessage {
+		return
+	}
+	l.inMessage = false
+	srv.log(LL_INFO, nil, "message %s", reason.String())
+	if l.hooks != nil {
+		l.hooks.OnMessageEnd(srv, reason)
+	}
+}
+
+// Check if the answer to the step ends the message
+func (l *lifecycle)stepDone(srv *Server, step MsgType, action *Action) {
+	if action == nil {
+		return
+	}
+	switch step {
+	case SMFIC_RCPT:
+		if action.Action != AC_ACCEPT && action.Action != AC_DISCARD {
+			return
+		}
+	case SMFIC_MAIL, SMFIC_HEADER, SMFIC_EOH, SMFIC_BODY, SMFIC_BODYEOB:
+	default:
+		return
+	}
+	switch {
+	case actionRank(action) > 0:
+		l.messageEnd(srv, ME_REJECTED)
+	case action.Action == AC_ACCEPT || step == SMFIC_BODYEOB:
+		l.messageEnd(srv, ME_ACCEPTED)
+	}
+}
+
+func (l *lifecycle)connectionClose(srv *Server) {
+	l.messageEnd(srv, ME_DISCONNECTED)
+	if l.hooks != nil {
+		l.hooks.OnConnectionClose(srv)
+	}
+}
+
+func (c *chain)OnConnectionOpen(srv *Server) {
+	if c.hooks != nil {
+		c.hooks.OnConnectionOpen(srv)
+	}
+}
+
+func (c *chain)OnMessageStart(srv *Server) {
+	if c.hooks != nil {
+		c.hooks.OnMessageStart(srv)
+	}
+}
+
+func (c *chain)OnMessageEnd(srv *Server, reason MessageEndReason) {
+	if c.hooks != nil {
+		c.hooks.OnMessageEnd(srv, reason)
+	}
+}
+
+func (c *chain)OnConnectionClose(srv *Server) {
+	if c.hooks != nil {
+		c.hooks.OnConnectionClose(srv)
+	}
+}
+
+// Call f for each member implementing LifecycleCallbacks
+func (c *composite)eachHooks(f func(LifecycleCallbacks)) {
+	var m *compositeMember
+	var hooks LifecycleCallbacks
+	var ok bool
+
+	for _, m = range c.members {
+		hooks, ok = m.inst.(LifecycleCallbacks)
+		if ok {
+			f(hooks)
+		}
+	}
+}
+
+func (c *composite)OnConnectionOpen(srv *Server) {
+	c.eachHooks(func(h LifecycleCallbacks) { h.OnConnectionOpen(srv) })
+}
+
+func (c *composite)OnMessageStart(srv *Server) {
+	c.eachHooks(func(h LifecycleCallbacks) { h.OnMessageStart(srv) })
+}
+
+func (c *composite)OnMessageEnd(srv *Server, reason MessageEndReason) {
+	c.eachHooks(func(h LifecycleCallbacks) { h.OnMessageEnd(srv, reason) })
+}
+
+func (c *composite)OnConnectionClose(srv *Server) {
+	c.endMessage()
+	c.eachHooks(func(h LifecycleCallbacks) { h.OnConnectionClose(srv) })
+}
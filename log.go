@@ -0,0 +1,184 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "encoding/hex"
+import "fmt"
+import "io"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// Define log verbosity. A logger receives records with a level lower or equal
+// than the configured level.
+//
+// ▶︎ LL_ERROR : errors which close the milter connection
+//
+// ▶︎ LL_WARNING : unexpected things which don't stop processing
+//
+// ▶︎ LL_INFO : connection and message lifecycle
+//
+// ▶︎ LL_DEBUG : each decoded message sent or received
+//
+// ▶︎ LL_TRACE : each raw packet sent or received, dumped in hexadecimal
+type LogLevel int
+const (
+	LL_NONE LogLevel = iota
+	LL_ERROR
+	LL_WARNING
+	LL_INFO
+	LL_DEBUG
+	LL_TRACE
+)
+
+// Display LogLevel as string for debug purpose
+func (l *LogLevel)String()(string) {
+	switch *l {
+	case LL_NONE:    return "none"
+	case LL_ERROR:   return "error"
+	case LL_WARNING: return "warning"
+	case LL_INFO:    return "info"
+	case LL_DEBUG:   return "debug"
+	case LL_TRACE:   return "trace"
+	}
+	return fmt.Sprintf("level[%d]", int(*l))
+}
+
+// This struct contains one log record. Side is "client" or "server". ConnID
+// is unique per Client or Server in the process. Peer is the remote network
+// address. Step is the current protocol step, it is the last command sent by
+// the client. MsgType is the message concerned by the record, it is 0 if the
+// record doesn't concern a message. QueueID is the value of the macro "i" once
+// the MTA sent it. Packet contains the raw packet for LL_TRACE records and
+// Direction says if the packet is sent or received.
+type LogRecord struct {
+	Time time.Time
+	Level LogLevel
+	Side string
+	ConnID uint64
+	Peer string
+	Step MsgType
+	MsgType MsgType
+	QueueID string
+	Direction Direction
+	Message string
+	Err error
+	Packet []byte
+}
+
+// Display LogRecord as one line of text. The packet is not displayed.
+func (r *LogRecord)String()(string) {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s %s %s conn=%d", r.Time.Format(time.RFC3339Nano), r.Level.String(), r.Side, r.ConnID)
+	if r.Peer != "" {
+		fmt.Fprintf(&b, " peer=%s", r.Peer)
+	}
+	if r.Step != 0 {
+		fmt.Fprintf(&b, " step=%s", r.Step.String())
+	}
+	if r.QueueID != "" {
+		fmt.Fprintf(&b, " queue-id=%s", r.QueueID)
+	}
+	if r.MsgType != 0 {
+		fmt.Fprintf(&b, " %s %s", r.Direction.String(), r.MsgType.String())
+	}
+	if r.Message != "" {
+		fmt.Fprintf(&b, " %s", r.Message)
+	}
+	if r.Err != nil {
+		fmt.Fprintf(&b, " error=%q", r.Err.Error())
+	}
+	return b.String()
+}
+
+// Logger interface receives log records from Client, Server and Exchange. The
+// record must not be kept after the function returns because the Packet
+// buffer could be reused.
+type Logger interface {
+	Log(*LogRecord)
+}
+
+// LoggerFunc allow using simple function as Logger.
+type LoggerFunc func(*LogRecord)
+
+// Implements Logger interface
+func (f LoggerFunc)Log(r *LogRecord) {
+	f(r)
+}
+
+type textLogger struct {
+	lock sync.Mutex
+	w io.Writer
+}
+
+func (l *textLogger)Log(r *LogRecord) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	fmt.Fprintf(l.w, "%s\n", r.String())
+	if r.Packet != nil {
+		io.WriteString(l.w, hex.Dump(r.Packet))
+	}
+}
+
+// This function returns Logger which writes one line per record on w. The
+// packets of LL_TRACE records are dumped in hexadecimal below the line.
+func TextLogger(w io.Writer)(Logger) {
+	return &textLogger{w: w}
+}
+
+// Unique id given to each Client and Server
+var lastConnID uint64
+
+func nextConnID()(uint64) {
+	return atomic.AddUint64(&lastConnID, 1)
+}
+
+// Returns short string describing the message value
+func valueString(value interface{})(string) {
+	var m *Macro
+	var list []string
+
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return qt(v)
+	case []byte:
+		return fmt.Sprintf("length=%d", len(v))
+	case []*Macro:
+		for _, m = range v {
+			list = append(list, fmt.Sprintf("%s=%s", m.Name, qt(m.Value)))
+		}
+		return strings.Join(list, ", ")
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// Common logging function for Client and Server.
+func logMessage(logger Logger, record *LogRecord, frame []byte) {
+	var msgType MsgType
+	var value interface{}
+	var err error
+
+	if record.Level == LL_TRACE {
+		record.Packet = frame
+	}
+
+	// Decode the frame to display the message
+	if len(frame) > 4 {
+		msgType, value, err = Decode(frame[4:])
+		if err != nil {
+			record.MsgType = toMsgType(frame[4])
+			record.Err = err
+		} else {
+			record.MsgType = msgType
+			record.Message = valueString(value)
+		}
+	}
+
+	logger.Log(record)
+}
@@ -3,6 +3,7 @@
 package milter
 
 import "fmt"
+import "strconv"
 
 type Macro struct {
 	Step MacroStep
@@ -17,32 +18,199 @@ func (m *Macro)String()(string) {
 	return fmt.Sprintf("step=%s, name=%s, value=%s", msgType.String(), qt(m.Name), qt(m.Value))
 }
 
-func macroAdd(macros *[]*Macro, step MacroStep, name string, value string)() {
+// This struct stores the macros. The lookup by name is O(1) and returns the
+// newest value, the macros of a later step override the macros of an earlier
+// step with the same name. The zero value is an empty store ready to use, and
+// the read functions accept nil store.
+type MacroStore struct {
+	macros []*Macro // in order, the newest last
+	index map[string]*Macro // newest macro for each name
+}
+
+// Create new empty MacroStore
+func MacroStoreNew()(*MacroStore) {
+	return &MacroStore{}
+}
+
+// Rebuild the index from the list
+func (ms *MacroStore)reindex() {
 	var m *Macro
 
-	/* lookup for existing macro. Do not append macros if already exists. */
-	for _, m = range *macros {
-		if m.Name == name {
-			return
+	ms.index = make(map[string]*Macro, len(ms.macros))
+	for _, m = range ms.macros {
+		ms.index[m.Name] = m
+	}
+}
+
+// Set the macro. If the name already exists, the new value and step replace
+// the existing ones. The index is updated in place.
+func (ms *MacroStore)Add(step MacroStep, name string, value string) {
+	var m *Macro
+	var kept []*Macro
+	var ok bool
+
+	/* remove existing macro. The new value replaces the existing one. */
+	_, ok = ms.index[name]
+	if ok {
+		for _, m = range ms.macros {
+			if m.Name != name {
+				kept = append(kept, m)
+			}
 		}
+		ms.macros = kept
+	}
+	m = &Macro{Step: step, Name: name, Value: value}
+	ms.macros = append(ms.macros, m)
+	if ms.index == nil {
+		ms.index = make(map[string]*Macro)
 	}
+	ms.index[name] = m
+}
 
-	m = &Macro{}
-	m.Step = step
-	m.Name = name
-	m.Value = value
-	*macros = append(*macros, m)
+// Replace all the macros of the step by the new ones. The MTA sends all the
+// macros of a step each time, so the previous values are obsolete. The new
+// macros are appended, so they override the same names of other steps.
+func (ms *MacroStore)SetStep(step MacroStep, values []*Macro) {
+	var m *Macro
+	var kept []*Macro
+
+	for _, m = range ms.macros {
+		if m.Step != step {
+			kept = append(kept, m)
+		}
+	}
+	for _, m = range values {
+		kept = append(kept, &Macro{Step: step, Name: m.Name, Value: m.Value})
+	}
+	ms.macros = kept
+	ms.reindex()
 }
 
-func macroGet(macros []*Macro, name string)(MacroStep, string) {
+// Remove the macros of the message steps. The macros of the connection
+// steps CONNECT and HELO are kept.
+func (ms *MacroStore)ClearMessage() {
 	var m *Macro
+	var kept []*Macro
 
-	for _, m = range macros {
-		if m.Name == name {
-			return m.Step, m.Value
+	for _, m = range ms.macros {
+		if m.Step == MS_CONNECT || m.Step == MS_HELO {
+			kept = append(kept, m)
+		}
+	}
+	ms.macros = kept
+	ms.reindex()
+}
+
+// Remove all the macros
+func (ms *MacroStore)Reset() {
+	ms.macros = nil
+	ms.index = nil
+}
+
+// Returns a copy of the store. The macros are never modified in place, so
+// they are shared.
+func (ms *MacroStore)clone()(*MacroStore) {
+	var c *MacroStore
+
+	c = MacroStoreNew()
+	if ms == nil {
+		return c
+	}
+	c.macros = append([]*Macro(nil), ms.macros...)
+	c.reindex()
+	return c
+}
+
+// Returns the newest value of the macro name. found is false if the macro
+// doesn't exist, so an empty value could be distinguished.
+func (ms *MacroStore)Lookup(name string)(string, bool) {
+	var m *Macro
+	var ok bool
+
+	if ms == nil {
+		return "", false
+	}
+	m, ok = ms.index[name]
+	if !ok {
+		return "", false
+	}
+	return m.Value, true
+}
+
+// Returns the step and the newest value of the macro name, or 0 and empty
+// string if none is found.
+func (ms *MacroStore)Get(name string)(MacroStep, string) {
+	var m *Macro
+	var ok bool
+
+	if ms == nil {
+		return 0, ""
+	}
+	m, ok = ms.index[name]
+	if !ok {
+		return 0, ""
+	}
+	return m.Step, m.Value
+}
+
+// Returns the macros of the step, in order.
+func (ms *MacroStore)Step(step MacroStep)([]*Macro) {
+	var m *Macro
+	var out []*Macro
+
+	if ms == nil {
+		return nil
+	}
+	for _, m = range ms.macros {
+		if m.Step == step {
+			out = append(out, m)
 		}
 	}
-	return 0, ""
+	return out
+}
+
+// Returns all the macros, in order. The slice must not be modified.
+func (ms *MacroStore)All()([]*Macro) {
+	if ms == nil {
+		return nil
+	}
+	return ms.macros
+}
+
+// Returns the macro value converted to int, or 0
+func (ms *MacroStore)getInt(name string)(int) {
+	var value string
+	var n int
+	var err error
+
+	value, _ = ms.Lookup(name)
+	n, err = strconv.Atoi(value)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// Returns the queue id, macro "i"
+func (ms *MacroStore)QueueID()(string)    { v, _ := ms.Lookup("i"); return v }
+// Returns the authenticated user, macro "{auth_authen}"
+func (ms *MacroStore)AuthUser()(string)   { v, _ := ms.Lookup("{auth_authen}"); return v }
+// Returns the authentication mechanism, macro "{auth_type}"
+func (ms *MacroStore)AuthType()(string)   { v, _ := ms.Lookup("{auth_type}"); return v }
+// Returns the TLS version, macro "{tls_version}"
+func (ms *MacroStore)TLSVersion()(string) { v, _ := ms.Lookup("{tls_version}"); return v }
+// Returns the daemon name, macro "{daemon_name}"
+func (ms *MacroStore)DaemonName()(string) { v, _ := ms.Lookup("{daemon_name}"); return v }
+// Returns the client certificate subject, macro "{cert_subject}"
+func (ms *MacroStore)CertSubject()(string) { v, _ := ms.Lookup("{cert_subject}"); return v }
+// Returns the cipher key length, macro "{cipher_bits}", or 0
+func (ms *MacroStore)CipherBits()(int)    { return ms.getInt("{cipher_bits}") }
+// Returns the client port, macro "{client_port}", or 0
+func (ms *MacroStore)ClientPort()(int)    { return ms.getInt("{client_port}") }
+
+// Display Macro summary on stdout.
+func (ms *MacroStore)Debug()() {
+	macroDebug(ms.All())
 }
 
 func macroDebug(macros []*Macro)() {
@@ -64,27 +232,43 @@ func macroDebug(macros []*Macro)() {
 //
 // 'R'	SMFIC_RCPT	${rcpt_mailer} ${rcpt_host} ${rcpt_addr}
 
-func macroAdd__(macros *[]*Macro, value string)            { macroAdd(macros, MS_CONNECT, "_", value) }
-func macroAdd_j(macros *[]*Macro, value string)            { macroAdd(macros, MS_CONNECT, "j", value) }
-func macroAdd_daemon_name(macros *[]*Macro, value string)  { macroAdd(macros, MS_CONNECT, "{daemon_name}", value) }
-func macroAdd_if_name(macros *[]*Macro, value string)      { macroAdd(macros, MS_CONNECT, "{if_name}", value) }
-func macroAdd_if_addr(macros *[]*Macro, value string)      { macroAdd(macros, MS_CONNECT, "{if_addr}", value) }
-
-func macroAdd_tls_version(macros *[]*Macro, value string)  { macroAdd(macros, MS_HELO,    "{tls_version}", value) }
-func macroAdd_cipher(macros *[]*Macro, value string)       { macroAdd(macros, MS_HELO,    "{cipher}", value) }
-func macroAdd_cipher_bits(macros *[]*Macro, value string)  { macroAdd(macros, MS_HELO,    "{cipher_bits}", value) }
-func macroAdd_cert_subject(macros *[]*Macro, value string) { macroAdd(macros, MS_HELO,    "{cert_subject}", value) }
-func macroAdd_cert_issuer(macros *[]*Macro, value string)  { macroAdd(macros, MS_HELO,    "{cert_issuer}", value) }
-
-func macroAdd_i(macros *[]*Macro, value string)            { macroAdd(macros, MS_MAIL,    "i", value) }
-func macroAdd_auth_type(macros *[]*Macro, value string)    { macroAdd(macros, MS_MAIL,    "{auth_type}", value) }
-func macroAdd_auth_authen(macros *[]*Macro, value string)  { macroAdd(macros, MS_MAIL,    "{auth_authen}", value) }
-func macroAdd_auth_ssf(macros *[]*Macro, value string)     { macroAdd(macros, MS_MAIL,    "{auth_ssf}", value) }
-func macroAdd_auth_author(macros *[]*Macro, value string)  { macroAdd(macros, MS_MAIL,    "{auth_author}", value) }
-func macroAdd_mail_mailer(macros *[]*Macro, value string)  { macroAdd(macros, MS_MAIL,    "{mail_mailer}", value) }
-func macroAdd_mail_host(macros *[]*Macro, value string)    { macroAdd(macros, MS_MAIL,    "{mail_host}", value) }
-func macroAdd_mail_addr(macros *[]*Macro, value string)    { macroAdd(macros, MS_MAIL,    "{mail_addr}", value) }
-
-func macroAdd_rcpt_mailer(macros *[]*Macro, value string)  { macroAdd(macros, MS_RCPT,    "{rcpt_mailer}", value) }
-func macroAdd_rcpt_host(macros *[]*Macro, value string)    { macroAdd(macros, MS_RCPT,    "{rcpt_host}", value) }
-func macroAdd_rcpt_addr(macros *[]*Macro, value string)    { macroAdd(macros, MS_RCPT,    "{rcpt_addr}", value) }
+func macroAdd__(macros *MacroStore, value string)                { macros.Add(MS_CONNECT, "_", value) }
+func macroAdd_j(macros *MacroStore, value string)                { macros.Add(MS_CONNECT, "j", value) }
+func macroAdd_daemon_name(macros *MacroStore, value string)      { macros.Add(MS_CONNECT, "{daemon_name}", value) }
+func macroAdd_if_name(macros *MacroStore, value string)          { macros.Add(MS_CONNECT, "{if_name}", value) }
+func macroAdd_if_addr(macros *MacroStore, value string)          { macros.Add(MS_CONNECT, "{if_addr}", value) }
+
+func macroAdd_tls_version(macros *MacroStore, value string)      { macros.Add(MS_HELO,    "{tls_version}", value) }
+func macroAdd_cipher(macros *MacroStore, value string)           { macros.Add(MS_HELO,    "{cipher}", value) }
+func macroAdd_cipher_bits(macros *MacroStore, value string)      { macros.Add(MS_HELO,    "{cipher_bits}", value) }
+func macroAdd_cert_subject(macros *MacroStore, value string)     { macros.Add(MS_HELO,    "{cert_subject}", value) }
+func macroAdd_cert_issuer(macros *MacroStore, value string)      { macros.Add(MS_HELO,    "{cert_issuer}", value) }
+
+func macroAdd_i(macros *MacroStore, value string)                { macros.Add(MS_MAIL,    "i", value) }
+func macroAdd_auth_type(macros *MacroStore, value string)        { macros.Add(MS_MAIL,    "{auth_type}", value) }
+func macroAdd_auth_authen(macros *MacroStore, value string)      { macros.Add(MS_MAIL,    "{auth_authen}", value) }
+func macroAdd_auth_ssf(macros *MacroStore, value string)         { macros.Add(MS_MAIL,    "{auth_ssf}", value) }
+func macroAdd_auth_author(macros *MacroStore, value string)      { macros.Add(MS_MAIL,    "{auth_author}", value) }
+func macroAdd_mail_mailer(macros *MacroStore, value string)      { macros.Add(MS_MAIL,    "{mail_mailer}", value) }
+func macroAdd_mail_host(macros *MacroStore, value string)        { macros.Add(MS_MAIL,    "{mail_host}", value) }
+func macroAdd_mail_addr(macros *MacroStore, value string)        { macros.Add(MS_MAIL,    "{mail_addr}", value) }
+
+func macroAdd_rcpt_mailer(macros *MacroStore, value string)      { macros.Add(MS_RCPT,    "{rcpt_mailer}", value) }
+func macroAdd_rcpt_host(macros *MacroStore, value string)        { macros.Add(MS_RCPT,    "{rcpt_host}", value) }
+func macroAdd_rcpt_addr(macros *MacroStore, value string)        { macros.Add(MS_RCPT,    "{rcpt_addr}", value) }
+
+// Postfix macros. They are sent at CONNECT step because Postfix defines
+// them for all the steps.
+//
+// 'C'	SMFIC_CONNECT	$v ${client_addr} ${client_name} ${client_ptr}
+// 			${client_port} ${client_connections}
+// 			${daemon_addr} ${daemon_port}
+
+func macroAdd_v(macros *MacroStore, value string)                { macros.Add(MS_CONNECT, "v", value) }
+func macroAdd_client_addr(macros *MacroStore, value string)      { macros.Add(MS_CONNECT, "{client_addr}", value) }
+func macroAdd_client_name(macros *MacroStore, value string)      { macros.Add(MS_CONNECT, "{client_name}", value) }
+func macroAdd_client_ptr(macros *MacroStore, value string)       { macros.Add(MS_CONNECT, "{client_ptr}", value) }
+func macroAdd_client_port(macros *MacroStore, value string)      { macros.Add(MS_CONNECT, "{client_port}", value) }
+func macroAdd_client_connections(macros *MacroStore, value string){ macros.Add(MS_CONNECT, "{client_connections}", value) }
+func macroAdd_daemon_addr(macros *MacroStore, value string)      { macros.Add(MS_CONNECT, "{daemon_addr}", value) }
+func macroAdd_daemon_port(macros *MacroStore, value string)      { macros.Add(MS_CONNECT, "{daemon_port}", value) }
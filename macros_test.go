@@ -0,0 +1,55 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "testing"
+
+func Test_macroStore(t *testing.T) {
+	var ms *MacroStore
+	var value string
+	var found bool
+
+	ms = MacroStoreNew()
+	ms.SetStep(MS_CONNECT, []*Macro{{Name: "{daemon_name}", Value: "smtpd"}, {Name: "{client_port}", Value: "4567"}})
+	ms.SetStep(MS_HELO, []*Macro{{Name: "{cipher_bits}", Value: "256"}, {Name: "{cert_subject}", Value: ""}})
+	ms.SetStep(MS_MAIL, []*Macro{{Name: "i", Value: "QUEUE1"}, {Name: "{auth_authen}", Value: "alice"}})
+
+	value, found = ms.Lookup("{cert_subject}")
+	if !found || value != "" {
+		t.Errorf("expect empty macro found")
+	}
+	_, found = ms.Lookup("{tls_version}")
+	if found {
+		t.Errorf("expect missing macro not found")
+	}
+	if ms.QueueID() != "QUEUE1" || ms.AuthUser() != "alice" || ms.CipherBits() != 256 || ms.ClientPort() != 4567 || ms.DaemonName() != "smtpd" {
+		t.Errorf("unexpected typed accessors")
+	}
+
+	// The later step overrides, clearing the message restores the connection value
+	ms.SetStep(MS_RCPT, []*Macro{{Name: "{daemon_name}", Value: "other"}})
+	if ms.DaemonName() != "other" || len(ms.Step(MS_RCPT)) != 1 {
+		t.Errorf("expect RCPT macro override")
+	}
+	ms.ClearMessage()
+	if ms.DaemonName() != "smtpd" || ms.QueueID() != "" || len(ms.All()) != 4 {
+		t.Errorf("expect message macros cleared")
+	}
+
+	// Add replaces all the values of the name, the zero value is usable
+	ms.Add(MS_MAIL, "{daemon_name}", "added")
+	if ms.DaemonName() != "added" || len(ms.All()) != 4 || len(ms.Step(MS_CONNECT)) != 1 {
+		t.Errorf("expect macro replaced by Add")
+	}
+	ms = &MacroStore{}
+	ms.Add(MS_CONNECT, "i", "QUEUE2")
+	if ms.QueueID() != "QUEUE2" || len(ms.All()) != 1 {
+		t.Errorf("expect macro added to zero store")
+	}
+
+	// nil store is readable
+	ms = nil
+	if ms.QueueID() != "" || ms.All() != nil {
+		t.Errorf("expect nil store empty")
+	}
+}
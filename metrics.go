@@ -0,0 +1,340 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "expvar"
+import "fmt"
+import "io"
+import "net/http"
+import "sort"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// Histogram upper bounds in seconds used for callback latency
+var latencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// The 64-bit atomic operations require 64-bit aligned words, which is not
+// guaranteed on 386 and 32-bit ARM, except for the first word of an
+// allocated struct. So the uint64 fields must stay at the start of the
+// struct, before any field with a size not multiple of 8, like a slice.
+type histogram struct {
+	count uint64
+	sum uint64 // nanoseconds
+	counts []uint64 // one per bucket, the last one is +Inf
+}
+
+func newHistogram()(*histogram) {
+	return &histogram{counts: make([]uint64, len(latencyBuckets) + 1)}
+}
+
+func (h *histogram)observe(d time.Duration) {
+	var i int
+	var seconds float64
+
+	seconds = d.Seconds()
+	for i = 0; i < len(latencyBuckets); i++ {
+		if seconds <= latencyBuckets[i] {
+			break
+		}
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+// This struct collects counters and latency histograms. The same Metrics
+// could be shared by many Client or Server, it is safe for concurrent use.
+// Set the field Metrics of Client or Server to enable collection. The
+// metrics are exposed using expvar with Publish, or using Prometheus text
+// format with WritePrometheus or ServeHTTP.
+//
+// ▶︎ connections : number of milter sessions, counted on OPTNEG
+//
+// ▶︎ messages : number of transactions, counted on MAIL
+//
+// ▶︎ received / sent : number of packets per message type. On server side,
+// the sent packets are actions and modifications.
+//
+// ▶︎ latency : time between the command sent by the MTA and the answer, per
+// step. On server side, this is the callback latency.
+//
+// ▶︎ bytes in / out : network bytes including packet headers.
+//
+// ▶︎ protocol errors : undecodable or unexpected packets.
+type Metrics struct {
+	// uint64 first for atomic alignment on 32-bit targets, see histogram
+	connections uint64
+	messages uint64
+	bytesIn uint64
+	bytesOut uint64
+	protocolErrors uint64
+	received [256]uint64
+	sent [256]uint64
+
+	lock sync.Mutex
+	latency map[MsgType]*histogram
+}
+
+// Create new empty Metrics
+func MetricsNew()(*Metrics) {
+	return &Metrics{latency: make(map[MsgType]*histogram)}
+}
+
+// returns true if the message is a command which expect an answer
+func expectAnswer(msgType MsgType)(bool) {
+	switch msgType {
+	case SMFIC_MACRO, SMFIC_ABORT, SMFIC_QUIT:
+		return false
+	}
+	return true
+}
+
+// returns true if the message is a final answer to a command
+func isAnswer(msgType MsgType)(bool) {
+	switch msgType {
+	case SMFIC_OPTNEG, SMFIR_ACCEPT, SMFIR_CONTINUE, SMFIR_DISCARD,
+	     SMFIR_REJECT, SMFIR_TEMPFAIL, SMFIR_REPLYCODE:
+		return true
+	}
+	return false
+}
+
+// returns true if the message is a command sent by the MTA. The commands
+// use upper case letters, the answers use lower case letters or signs,
+// except OPTNEG which is sent by both. The MTA sends it first, when no
+// command waits for an answer.
+func isRequest(msgType MsgType, since time.Time)(bool) {
+	if msgType == SMFIC_OPTNEG {
+		return since.IsZero()
+	}
+	return msgType >= 'A' && msgType <= 'Z'
+}
+
+// This function is called by Client and Server for each packet. since
+// contains the time of the last command which expect an answer.
+func (m *Metrics)observeFrame(dir Direction, frame []byte, step MsgType, since *time.Time) {
+	var msgType MsgType
+
+	if dir == DIR_IN {
+		atomic.AddUint64(&m.bytesIn, uint64(len(frame)))
+	} else {
+		atomic.AddUint64(&m.bytesOut, uint64(len(frame)))
+	}
+	if len(frame) < 5 {
+		return
+	}
+
+	msgType = MsgType(frame[4])
+	if dir == DIR_IN {
+		atomic.AddUint64(&m.received[msgType], 1)
+	} else {
+		atomic.AddUint64(&m.sent[msgType], 1)
+	}
+
+	if isRequest(msgType, *since) {
+		switch msgType {
+		case SMFIC_OPTNEG: atomic.AddUint64(&m.connections, 1)
+		case SMFIC_MAIL:   atomic.AddUint64(&m.messages, 1)
+		}
+		if expectAnswer(msgType) {
+			*since = time.Now()
+		}
+		return
+	}
+
+	if isAnswer(msgType) && !since.IsZero() {
+		m.observeLatency(step, time.Since(*since))
+		*since = time.Time{}
+	}
+}
+
+func (m *Metrics)observeLatency(step MsgType, d time.Duration) {
+	var h *histogram
+
+	m.lock.Lock()
+	if m.latency == nil {
+		m.latency = make(map[MsgType]*histogram)
+	}
+	h = m.latency[step]
+	if h == nil {
+		h = newHistogram()
+		m.latency[step] = h
+	}
+	m.lock.Unlock()
+
+	h.observe(d)
+}
+
+func (m *Metrics)protocolError() {
+	atomic.AddUint64(&m.protocolErrors, 1)
+}
+
+// returns copy of latency histograms sorted by step
+func (m *Metrics)latencies()([]MsgType, []*histogram) {
+	var steps []MsgType
+	var hists []*histogram
+	var step MsgType
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for step = range m.latency {
+		steps = append(steps, step)
+	}
+	sort.Slice(steps, func(i, j int)(bool) { return steps[i] < steps[j] })
+	for _, step = range steps {
+		hists = append(hists, m.latency[step])
+	}
+	return steps, hists
+}
+
+func counterMap(counters *[256]uint64)(map[string]uint64) {
+	var i int
+	var v uint64
+	var msgType MsgType
+	var out map[string]uint64
+
+	out = make(map[string]uint64)
+	for i = range counters {
+		v = atomic.LoadUint64(&counters[i])
+		if v == 0 {
+			continue
+		}
+		msgType = MsgType(i)
+		out[msgType.String()] = v
+	}
+	return out
+}
+
+// This function returns a snapshot of the metrics as a map. It is the value
+// exposed by expvar.
+func (m *Metrics)Snapshot()(map[string]interface{}) {
+	var out map[string]interface{}
+	var latency map[string]interface{}
+	var steps []MsgType
+	var hists []*histogram
+	var i int
+
+	latency = make(map[string]interface{})
+	steps, hists = m.latencies()
+	for i = range steps {
+		latency[steps[i].String()] = map[string]interface{}{
+			"count": atomic.LoadUint64(&hists[i].count),
+			"sum_seconds": time.Duration(atomic.LoadUint64(&hists[i].sum)).Seconds(),
+		}
+	}
+
+	out = map[string]interface{}{
+		"connections": atomic.LoadUint64(&m.connections),
+		"messages": atomic.LoadUint64(&m.messages),
+		"bytes_in": atomic.LoadUint64(&m.bytesIn),
+		"bytes_out": atomic.LoadUint64(&m.bytesOut),
+		"protocol_errors": atomic.LoadUint64(&m.protocolErrors),
+		"received": counterMap(&m.received),
+		"sent": counterMap(&m.sent),
+		"latency": latency,
+	}
+	return out
+}
+
+// Publish the metrics using expvar with the given name. Like expvar.Publish,
+// it panics if the name is already used.
+func (m *Metrics)Publish(name string) {
+	expvar.Publish(name, expvar.Func(func()(interface{}) {
+		return m.Snapshot()
+	}))
+}
+
+func writeCounters(w io.Writer, name string, help string, counters *[256]uint64)(error) {
+	var i int
+	var v uint64
+	var msgType MsgType
+	var err error
+
+	_, err = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	if err != nil {
+		return err
+	}
+	for i = range counters {
+		v = atomic.LoadUint64(&counters[i])
+		if v == 0 {
+			continue
+		}
+		msgType = MsgType(i)
+		_, err = fmt.Fprintf(w, "%s{type=%q} %d\n", name, msgType.String(), v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the metrics using Prometheus text exposition format. All the metric
+// names are prefixed by "milter_".
+func (m *Metrics)WritePrometheus(w io.Writer)(error) {
+	var err error
+	var steps []MsgType
+	var hists []*histogram
+	var i int
+	var j int
+	var cumul uint64
+	var counters []struct{ name string; help string; value uint64 }
+	var c struct{ name string; help string; value uint64 }
+
+	counters = []struct{ name string; help string; value uint64 }{
+		{"milter_connections_total", "Number of milter sessions.", atomic.LoadUint64(&m.connections)},
+		{"milter_messages_total", "Number of transactions.", atomic.LoadUint64(&m.messages)},
+		{"milter_bytes_in_total", "Number of bytes received.", atomic.LoadUint64(&m.bytesIn)},
+		{"milter_bytes_out_total", "Number of bytes sent.", atomic.LoadUint64(&m.bytesOut)},
+		{"milter_protocol_errors_total", "Number of protocol errors.", atomic.LoadUint64(&m.protocolErrors)},
+	}
+	for _, c = range counters {
+		_, err = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeCounters(w, "milter_received_total", "Number of packets received per message type.", &m.received)
+	if err != nil {
+		return err
+	}
+	err = writeCounters(w, "milter_sent_total", "Number of packets sent per message type.", &m.sent)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "# HELP milter_latency_seconds Time between command and answer per step.\n# TYPE milter_latency_seconds histogram\n")
+	if err != nil {
+		return err
+	}
+	steps, hists = m.latencies()
+	for i = range steps {
+		cumul = 0
+		for j = range hists[i].counts {
+			cumul += atomic.LoadUint64(&hists[i].counts[j])
+			if j < len(latencyBuckets) {
+				_, err = fmt.Fprintf(w, "milter_latency_seconds_bucket{step=%q,le=\"%g\"} %d\n", steps[i].String(), latencyBuckets[j], cumul)
+			} else {
+				_, err = fmt.Fprintf(w, "milter_latency_seconds_bucket{step=%q,le=\"+Inf\"} %d\n", steps[i].String(), cumul)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(w, "milter_latency_seconds_sum{step=%q} %g\nmilter_latency_seconds_count{step=%q} %d\n",
+		                     steps[i].String(), time.Duration(atomic.LoadUint64(&hists[i].sum)).Seconds(),
+		                     steps[i].String(), atomic.LoadUint64(&hists[i].count))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Implements http.Handler. It serves the metrics using Prometheus text format.
+func (m *Metrics)ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WritePrometheus(w)
+}
@@ -0,0 +1,361 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "fmt"
+import "net"
+import "time"
+
+// This struct contains the result of one callback. Only the fields which
+// make sense for the step are used:
+//
+// ▶︎ SMFIC_OPTNEG : OptNeg
+//
+// ▶︎ SMFIC_CONNECT ... SMFIC_BODY : Action
+//
+// ▶︎ SMFIC_BODYEOB : Action and Modifications
+//
+// ▶︎ SMFIC_ABORT, SMFIC_QUIT, SMFIR_ERROR : none, the verdict is nil
+type Verdict struct {
+	OptNeg *MsgOptNeg
+	Action *Action
+	Modifications []*Modification
+}
+
+// Handler processes one step. step is the command received, SMFIR_ERROR is
+// used for OnERROR. value is the argument of the callback, see Decode to
+// understand cast between MsgType and interface{}. For SMFIR_ERROR, value is
+// the error.
+type Handler func(srv *Server, step MsgType, value interface{})(*Verdict, error)
+
+// Middleware wraps Handler. It could observe the step, call next or not, and
+// change the returned verdict.
+type Middleware func(next Handler)(Handler)
+
+type chain struct {
+	handler Handler
+	hooks LifecycleCallbacks
+}
+
+// This function returns ServerCallbacks which pass each step through the
+// middlewares before calling the handler. The first middleware is the
+// outermost, it is called first. If the handler implements BodyStreamer,
+// the body is streamed to it, and the middlewares see the BODY steps
+// answered CONTINUE and the BODYEOB step with the result of OnBODYSTREAM.
+func Chain(handler ServerCallbacks, mw ...Middleware)(ServerCallbacks) {
+	var c *chain
+	var h Handler
+	var i int
+
+	h = callbacksHandler(handler)
+	for i = len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	c = &chain{handler: h}
+	c.hooks, _ = handler.(LifecycleCallbacks)
+	return c
+}
+
+// Convert ServerCallbacks to Handler
+func callbacksHandler(inst ServerCallbacks)(Handler) {
+	return func(srv *Server, step MsgType, value interface{})(*Verdict, error) {
+		var verdict *Verdict
+		var err error
+
+		verdict = &Verdict{}
+		switch step {
+		case SMFIC_OPTNEG:  verdict.OptNeg, err = inst.OnOPTNEG(srv, value.(*MsgOptNeg))
+		case SMFIC_CONNECT: verdict.Action, err = inst.OnCONNECT(srv, value.(*MsgConnect))
+		case SMFIC_HELO:    verdict.Action, err = inst.OnHELO(srv, value.(string))
+		case SMFIC_MAIL:    verdict.Action, err = inst.OnMAIL(srv, value.(*MsgMail))
+		case SMFIC_RCPT:    verdict.Action, err = inst.OnRCPT(srv, value.(*MsgMail))
+		case SMFIC_HEADER:  verdict.Action, err = inst.OnHEADER(srv, value.(*MsgHeader))
+		case SMFIC_EOH:     verdict.Action, err = inst.OnEOH(srv)
+		case SMFIC_BODY:    verdict.Action, err = srv.callBody(inst, value.([]byte))
+		case SMFIC_BODYEOB: verdict.Modifications, verdict.Action, err = srv.callBodyEOB(inst)
+		case SMFIC_ABORT:   return nil, inst.OnABORT(srv)
+		case SMFIC_QUIT:    return nil, inst.OnQUIT(srv)
+		case SMFIR_ERROR:   inst.OnERROR(srv, value.(error)); return nil, nil
+		default:            return nil, fmt.Errorf("unexpected step %s", step.String())
+		}
+		return verdict, err
+	}
+}
+
+// Returns action from verdict, an empty verdict is CONTINUE
+func (c *chain)action(srv *Server, step MsgType, value interface{})(*Action, error) {
+	var verdict *Verdict
+	var err error
+
+	verdict, err = c.handler(srv, step, value)
+	if err != nil {
+		return nil, err
+	}
+	if verdict == nil || verdict.Action == nil {
+		return ActionContinue(), nil
+	}
+	return verdict.Action, nil
+}
+
+func (c *chain)OnOPTNEG(srv *Server, optNeg *MsgOptNeg)(*MsgOptNeg, error) {
+	var verdict *Verdict
+	var err error
+
+	verdict, err = c.handler(srv, SMFIC_OPTNEG, optNeg)
+	if err != nil {
+		return nil, err
+	}
+	if verdict == nil || verdict.OptNeg == nil {
+		return nil, fmt.Errorf("no option negotiation returned")
+	}
+	return verdict.OptNeg, nil
+}
+
+func (c *chain)OnCONNECT(srv *Server, connect *MsgConnect)(*Action, error) {
+	return c.action(srv, SMFIC_CONNECT, connect)
+}
+
+func (c *chain)OnHELO(srv *Server, helo string)(*Action, error) {
+	return c.action(srv, SMFIC_HELO, helo)
+}
+
+func (c *chain)OnMAIL(srv *Server, mail *MsgMail)(*Action, error) {
+	return c.action(srv, SMFIC_MAIL, mail)
+}
+
+func (c *chain)OnRCPT(srv *Server, rcpt *MsgMail)(*Action, error) {
+	return c.action(srv, SMFIC_RCPT, rcpt)
+}
+
+func (c *chain)OnHEADER(srv *Server, header *MsgHeader)(*Action, error) {
+	return c.action(srv, SMFIC_HEADER, header)
+}
+
+func (c *chain)OnEOH(srv *Server)(*Action, error) {
+	return c.action(srv, SMFIC_EOH, nil)
+}
+
+func (c *chain)OnBODY(srv *Server, body []byte)(*Action, error) {
+	return c.action(srv, SMFIC_BODY, body)
+}
+
+func (c *chain)OnBODYEOB(srv *Server)([]*Modification, *Action, error) {
+	var verdict *Verdict
+	var err error
+
+	verdict, err = c.handler(srv, SMFIC_BODYEOB, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if verdict == nil {
+		return nil, ActionContinue(), nil
+	}
+	if verdict.Action == nil {
+		return verdict.Modifications, ActionContinue(), nil
+	}
+	return verdict.Modifications, verdict.Action, nil
+}
+
+func (c *chain)OnABORT(srv *Server)(error) {
+	var err error
+
+	_, err = c.handler(srv, SMFIC_ABORT, nil)
+	return err
+}
+
+func (c *chain)OnQUIT(srv *Server)(error) {
+	var err error
+
+	_, err = c.handler(srv, SMFIC_QUIT, nil)
+	return err
+}
+
+func (c *chain)OnERROR(srv *Server, err error) {
+	c.handler(srv, SMFIR_ERROR, err)
+}
+
+// Returns true if the step expect an action as response
+func stepHasAction(step MsgType)(bool) {
+	switch step {
+	case SMFIC_CONNECT, SMFIC_HELO, SMFIC_MAIL, SMFIC_RCPT,
+	     SMFIC_HEADER, SMFIC_EOH, SMFIC_BODY, SMFIC_BODYEOB:
+		return true
+	}
+	return false
+}
+
+// This middleware logs each step with its verdict and duration using the
+// server Logger. The records are emitted with the given level.
+func LogMiddleware(level LogLevel)(Middleware) {
+	return func(next Handler)(Handler) {
+		return func(srv *Server, step MsgType, value interface{})(*Verdict, error) {
+			var verdict *Verdict
+			var err error
+			var start time.Time
+
+			start = time.Now()
+			verdict, err = next(srv, step, value)
+			if verdict != nil && verdict.Action != nil {
+				srv.log(level, err, "%s callback returns %s with %d modifications in %s",
+				        step.String(), verdict.Action.Action.String(), len(verdict.Modifications), time.Since(start))
+			} else {
+				srv.log(level, err, "%s callback done in %s", step.String(), time.Since(start))
+			}
+			return verdict, err
+		}
+	}
+}
+
+// This middleware measures the callback latency per step in m. Note the
+// Server Metrics field already measures the latency between command and
+// answer, so this middleware is useful when only the callback duration is
+// expected, or when the server metrics are not enabled.
+func MetricsMiddleware(m *Metrics)(Middleware) {
+	return func(next Handler)(Handler) {
+		return func(srv *Server, step MsgType, value interface{})(*Verdict, error) {
+			var verdict *Verdict
+			var err error
+			var start time.Time
+
+			start = time.Now()
+			verdict, err = next(srv, step, value)
+			if stepHasAction(step) {
+				m.observeLatency(step, time.Since(start))
+			}
+			return verdict, err
+		}
+	}
+}
+
+// This middleware returns action if the callback doesn't answer before
+// timeout. It applies only on the steps which expect an action. The next
+// handlers run in their own goroutine with a detached copy of srv: its
+// macros and transaction are a snapshot, it has no connection so the Send*
+// functions fail, and at BODYEOB it owns the body until it returns. If the
+// timeout is reached, srv.Cancelled is closed and Exchange processes the
+// next commands while the callback continues running. The result of the
+// late callback is ignored, it is logged at LL_WARNING level when the
+// callback returns.
+func TimeoutMiddleware(timeout time.Duration, action *Action)(Middleware) {
+	type result struct {
+		verdict *Verdict
+		err error
+	}
+
+	return func(next Handler)(Handler) {
+		return func(srv *Server, step MsgType, value interface{})(*Verdict, error) {
+			var done chan result
+			var res result
+			var timer *time.Timer
+			var cancel chan struct{}
+			var detached *Server
+
+			if !stepHasAction(step) {
+				return next(srv, step, value)
+			}
+
+			done = make(chan result, 1)
+			cancel = make(chan struct{})
+			detached = srv.detach(cancel)
+			if step == SMFIC_BODYEOB {
+				detached.BodyBuffer = srv.BodyBuffer
+			}
+			go func() {
+				var res result
+
+				res.verdict, res.err = next(detached, step, value)
+				done <- res
+			}()
+
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+
+			select {
+			case res = <-done:
+				return res.verdict, res.err
+			case <-timer.C:
+				close(cancel)
+				srv.log(LL_WARNING, nil, "%s callback timeout after %s", step.String(), timeout)
+
+				// The late callback keeps the body, the server continues
+				// with an empty one
+				if detached.BodyBuffer != nil {
+					srv.BodyBuffer = detached.BodyBuffer.fresh()
+				}
+				if step == SMFIC_BODYEOB {
+					srv.stream = &bodyStream{}
+				}
+				go func() {
+					var res result
+
+					res = <-done
+					if detached.BodyBuffer != nil {
+						detached.BodyBuffer.reset()
+					}
+					if res.verdict != nil && res.verdict.Action != nil {
+						detached.log(LL_WARNING, res.err, "%s late callback returns %s, ignored", step.String(), res.verdict.Action.Action.String())
+					} else {
+						detached.log(LL_WARNING, res.err, "%s late callback returns, ignored", step.String())
+					}
+				}()
+				return &Verdict{Action: action}, nil
+			}
+		}
+	}
+}
+
+// This middleware accepts the connections coming from the given networks
+// without calling the next handlers. The MTA doesn't send more command for
+// an accepted connection.
+func AllowListMiddleware(nets []*net.IPNet)(Middleware) {
+	return func(next Handler)(Handler) {
+		return func(srv *Server, step MsgType, value interface{})(*Verdict, error) {
+			var connect *MsgConnect
+			var ip net.IP
+			var n *net.IPNet
+
+			if step != SMFIC_CONNECT {
+				return next(srv, step, value)
+			}
+
+			connect = value.(*MsgConnect)
+			ip = net.ParseIP(connect.Address)
+			if ip != nil {
+				for _, n = range nets {
+					if n.Contains(ip) {
+						srv.log(LL_INFO, nil, "client %s accepted by allow-list", connect.Address)
+						return &Verdict{Action: ActionAccept()}, nil
+					}
+				}
+			}
+			return next(srv, step, value)
+		}
+	}
+}
+
+// This middleware calls the next handlers, logs their verdict at LL_INFO
+// level, but always returns CONTINUE without modification. It allows testing
+// a milter in production without impacting the mail flow.
+func DryRunMiddleware()(Middleware) {
+	return func(next Handler)(Handler) {
+		return func(srv *Server, step MsgType, value interface{})(*Verdict, error) {
+			var verdict *Verdict
+			var err error
+			var mod *Modification
+
+			verdict, err = next(srv, step, value)
+			if err != nil || verdict == nil || !stepHasAction(step) {
+				return verdict, err
+			}
+
+			if verdict.Action != nil && verdict.Action.Action != AC_CONTINUE {
+				srv.log(LL_INFO, nil, "dry-run: %s callback returns %s", step.String(), verdict.Action.String())
+			}
+			for _, mod = range verdict.Modifications {
+				srv.log(LL_INFO, nil, "dry-run: %s callback returns modification %s", step.String(), mod.String())
+			}
+
+			return &Verdict{Action: ActionContinue()}, nil
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "io"
+import "io/ioutil"
+import "net"
+import "testing"
+import "time"
+
+func Test_middlewareChain(t *testing.T) {
+	var cli *Client
+	var done func()
+	var inst *testCallbacks
+	var steps []MsgType
+	var record Middleware
+	var mods []*Modification
+	var action *Action
+	var nets []*net.IPNet
+	var n *net.IPNet
+
+	inst = &testCallbacks{
+		onBODYEOB: func(srv *Server)([]*Modification, *Action, error) {
+			return []*Modification{ModificationAddHeader("X-Test", "1")}, ActionReject(), nil
+		},
+	}
+	record = func(next Handler)(Handler) {
+		return func(srv *Server, step MsgType, value interface{})(*Verdict, error) {
+			steps = append(steps, step)
+			return next(srv, step, value)
+		}
+	}
+
+	// The recorder sees all the steps, the dry-run cancels the reject
+	cli, done = testPipe(t, Chain(inst, record, DryRunMiddleware(), TimeoutMiddleware(time.Second, ActionTempfail())), nil)
+	mods, action = testMessage(t, cli)
+	done()
+	if len(mods) != 0 || action.Action != AC_CONTINUE {
+		t.Errorf("expect CONTINUE without modification in dry-run, got %s and %d modifications", action.String(), len(mods))
+	}
+	if len(steps) != 10 || steps[0] != SMFIC_OPTNEG || steps[8] != SMFIC_BODYEOB || steps[9] != SMFIC_QUIT {
+		t.Errorf("unexpected steps %v", steps)
+	}
+
+	// The allow-list accepts the connection before the handler
+	_, n, _ = net.ParseCIDR("192.0.2.0/24")
+	nets = append(nets, n)
+	cli, done = testPipe(t, Chain(inst, AllowListMiddleware(nets)), nil)
+	action, _ = cli.ExchangeConnect(&MsgConnect{Hostname: "client.example", Family: SMFIA_INET, Port: 4567, Address: "192.0.2.1"})
+	done()
+	if action == nil || action.Action != AC_ACCEPT {
+		t.Errorf("expect ACCEPT from allow-list")
+	}
+}
+
+func Test_middlewareTimeout(t *testing.T) {
+	var mw Middleware
+	var srv *Server
+	var logs chan string
+	var verdict *Verdict
+	var err error
+
+	logs = make(chan string, 2)
+	srv = &Server{LogLevel: LL_WARNING}
+	srv.Logger = LoggerFunc(func(r *LogRecord) { logs <- r.Message })
+	mw = TimeoutMiddleware(10 * time.Millisecond, ActionTempfail())
+	verdict, err = mw(func(srv *Server, step MsgType, value interface{})(*Verdict, error) {
+		select {
+		case <-srv.Cancelled():
+			return &Verdict{Action: ActionReject()}, nil
+		case <-time.After(time.Second):
+			return &Verdict{Action: ActionContinue()}, nil
+		}
+	})(srv, SMFIC_HELO, "client.example")
+	if err != nil || verdict.Action.Action != AC_TEMPFAIL {
+		t.Errorf("expect TEMPFAIL on timeout")
+	}
+
+	// The callback is cancelled, and its late verdict is logged
+	if <-logs != "HELO callback timeout after 10ms" {
+		t.Errorf("expect timeout log")
+	}
+	select {
+	case msg := <-logs:
+		if msg != "HELO late callback returns REJECT, ignored" {
+			t.Errorf("unexpected log %q", msg)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Errorf("expect callback cancelled")
+	}
+}
+
+type testSlowHelo struct {
+	testCallbacks
+}
+
+func (ts *testSlowHelo)OnHELO(srv *Server, helo string)(*Action, error) {
+	time.Sleep(50 * time.Millisecond)
+	return ActionReject(), nil
+}
+
+func Test_middlewareTimeoutDetached(t *testing.T) {
+	var inst *testSlowHelo
+	var cli *Client
+	var done func()
+	var logs chan string
+	var body chan string
+	var action *Action
+	var late int
+
+	logs = make(chan string, 100)
+	body = make(chan string, 1)
+	inst = &testSlowHelo{}
+	inst.onBODYEOB = func(srv *Server)([]*Modification, *Action, error) {
+		var data []byte
+		var r io.ReadSeeker
+
+		time.Sleep(50 * time.Millisecond)
+		r, _ = srv.Body()
+		data, _ = ioutil.ReadAll(r)
+		body <- string(data)
+		return nil, ActionReject(), nil
+	}
+
+	// The logging middleware inside the timeout uses srv after the timeout
+	// while Exchange processes the next commands.
+	cli, done = testPipe(t, Chain(inst, TimeoutMiddleware(10 * time.Millisecond, ActionTempfail()), LogMiddleware(LL_INFO)), func(srv *Server) {
+		srv.Logger = LoggerFunc(func(r *LogRecord) { logs <- r.Message })
+		srv.LogLevel = LL_INFO
+		srv.BodyBuffer = &BodyBuffer{}
+	})
+	cli.Macros.Add(MS_MAIL, "i", "QUEUE1")
+	_, action = testMessage(t, cli)
+	if action.Action != AC_TEMPFAIL {
+		t.Errorf("expect TEMPFAIL on timeout, got %s", action.String())
+	}
+
+	// The late callback keeps its body
+	select {
+	case data := <-body:
+		if data != "Hello\r\n" {
+			t.Errorf("unexpected body %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect late BODYEOB callback")
+	}
+	done()
+
+	for late < 2 {
+		select {
+		case msg := <-logs:
+			if msg == "HELO late callback returns REJECT, ignored" || msg == "BODYEOB late callback returns REJECT, ignored" {
+				late++
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect late callbacks logged")
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "bytes"
+import "encoding/base64"
+import "io"
+import "io/ioutil"
+import "mime"
+import "mime/multipart"
+import "mime/quotedprintable"
+import "net/mail"
+import "net/textproto"
+import "strings"
+
+// This struct is one node of the MIME tree. Header contains the raw header
+// values of the part, HeaderDecoded returns them with RFC 2047 encoded words
+// decoded. ContentType is the lower case media type, "text/plain" by default,
+// and Params its parameters. Filename comes from the Content-Disposition or
+// the Content-Type name parameter. For multipart, Parts contains the children
+// and Body is nil. Otherwise, Body contains the content with the transfer
+// encoding (base64, quoted-printable) decoded.
+type MIMEPart struct {
+	Header mail.Header
+	ContentType string
+	Params map[string]string
+	Disposition string
+	Filename string
+	Body []byte
+	Parts []*MIMEPart
+}
+
+var wordDecoder = &mime.WordDecoder{}
+
+// Returns the first value of the header name with RFC 2047 encoded words
+// decoded. If the value can't be decoded, the raw value is returned.
+func (p *MIMEPart)HeaderDecoded(name string)(string) {
+	var value string
+	var decoded string
+	var err error
+
+	value = p.Header.Get(name)
+	decoded, err = wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// Returns true if the part is an attachment, it means it has filename or
+// its disposition is "attachment".
+func (p *MIMEPart)IsAttachment()(bool) {
+	return p.Disposition == "attachment" || p.Filename != ""
+}
+
+// Call f for each part of the tree, depth first. The multipart nodes are
+// visited before their children.
+func (p *MIMEPart)Walk(f func(*MIMEPart)) {
+	var child *MIMEPart
+
+	f(p)
+	for _, child = range p.Parts {
+		child.Walk(f)
+	}
+}
+
+// This function parses the message from its headers and its body, like
+// the ones collected by the server in Transaction and BodyBuffer. It is
+// designed for OnBODYEOB, like:
+//
+//    body, _ := srv.Body()
+//    root, err := milter.ParseMIME(srv.Transaction().Headers, body)
+func ParseMIME(headers []*MsgHeader, body io.Reader)(*MIMEPart, error) {
+	var h mail.Header
+	var hdr *MsgHeader
+	var key string
+
+	h = make(mail.Header)
+	for _, hdr = range headers {
+		key = textproto.CanonicalMIMEHeaderKey(hdr.Name)
+		h[key] = append(h[key], strings.TrimLeft(hdr.Value, " \t"))
+	}
+	return parsePart(h, body)
+}
+
+// Parse the full message, headers included
+func ParseMIMEMessage(r io.Reader)(*MIMEPart, error) {
+	var msg *mail.Message
+	var err error
+
+	msg, err = mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	return parsePart(msg.Header, msg.Body)
+}
+
+func parsePart(h mail.Header, body io.Reader)(*MIMEPart, error) {
+	var part *MIMEPart
+	var err error
+	var params map[string]string
+	var mr *multipart.Reader
+	var mp *multipart.Part
+	var child *MIMEPart
+	var filename string
+
+	part = &MIMEPart{Header: h, ContentType: "text/plain", Params: map[string]string{}}
+
+	if h.Get("Content-Type") != "" {
+		part.ContentType, params, err = mime.ParseMediaType(h.Get("Content-Type"))
+		if err == nil {
+			part.Params = params
+		} else {
+			part.ContentType = "application/octet-stream"
+		}
+	}
+	if h.Get("Content-Disposition") != "" {
+		part.Disposition, params, err = mime.ParseMediaType(h.Get("Content-Disposition"))
+		if err == nil {
+			filename = params["filename"]
+		}
+	}
+	if filename == "" {
+		filename = part.Params["name"]
+	}
+	part.Filename, err = wordDecoder.DecodeHeader(filename)
+	if err != nil {
+		part.Filename = filename
+	}
+
+	// Multipart: parse children
+	if strings.HasPrefix(part.ContentType, "multipart/") && part.Params["boundary"] != "" {
+		mr = multipart.NewReader(body, part.Params["boundary"])
+		for {
+			// NextRawPart keeps the transfer encoding, it is decoded below
+			mp, err = mr.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return part, err
+			}
+			child, err = parsePart(mail.Header(mp.Header), mp)
+			if err != nil {
+				return part, err
+			}
+			part.Parts = append(part.Parts, child)
+		}
+		return part, nil
+	}
+
+	// Embedded message
+	if part.ContentType == "message/rfc822" {
+		part.Body, err = ioutil.ReadAll(decodeTransfer(h, body))
+		if err != nil {
+			return part, err
+		}
+		child, err = ParseMIMEMessage(bytes.NewReader(part.Body))
+		if err == nil {
+			part.Parts = append(part.Parts, child)
+		}
+		return part, nil
+	}
+
+	part.Body, err = ioutil.ReadAll(decodeTransfer(h, body))
+	return part, err
+}
+
+// Returns reader which decodes the Content-Transfer-Encoding
+func decodeTransfer(h mail.Header, r io.Reader)(io.Reader) {
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// Remove the line breaks and spaces which are not part of base64 alphabet
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner)Read(p []byte)(int, error) {
+	var n int
+	var i int
+	var j int
+	var err error
+
+	for {
+		n, err = c.r.Read(p)
+		j = 0
+		for i = 0; i < n; i++ {
+			switch p[i] {
+			case '\r', '\n', ' ', '\t':
+			default:
+				p[j] = p[i]
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
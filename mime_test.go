@@ -0,0 +1,53 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "strings"
+import "testing"
+
+func Test_parseMIME(t *testing.T) {
+	var headers []*MsgHeader
+	var body string
+	var root *MIMEPart
+	var attachments []*MIMEPart
+	var err error
+
+	headers = []*MsgHeader{
+		{Name: "Subject", Value: " =?UTF-8?Q?caf=C3=A9?="},
+		{Name: "MIME-Version", Value: "1.0"},
+		{Name: "content-type", Value: "multipart/mixed; boundary=\"XX\""},
+	}
+	body = "preamble\r\n" +
+	       "--XX\r\n" +
+	       "Content-Type: text/plain; charset=utf-8\r\n" +
+	       "Content-Transfer-Encoding: quoted-printable\r\n" +
+	       "\r\n" +
+	       "caf=C3=A9 =\r\nsoft break\r\n" +
+	       "--XX\r\n" +
+	       "Content-Type: application/pdf; name=\"ignored.pdf\"\r\n" +
+	       "Content-Disposition: attachment; filename=\"=?UTF-8?B?csOpc3VtZS5wZGY=?=\"\r\n" +
+	       "Content-Transfer-Encoding: base64\r\n" +
+	       "\r\n" +
+	       "JVBERi0x\r\nLjQK\r\n" +
+	       "--XX--\r\n"
+
+	root, err = ParseMIME(headers, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if root.HeaderDecoded("subject") != "café" || root.ContentType != "multipart/mixed" || len(root.Parts) != 2 {
+		t.Fatalf("unexpected root %#v", root)
+	}
+	if string(root.Parts[0].Body) != "café soft break" || root.Parts[0].Params["charset"] != "utf-8" {
+		t.Errorf("unexpected text part %q", root.Parts[0].Body)
+	}
+
+	root.Walk(func(p *MIMEPart) {
+		if p.IsAttachment() {
+			attachments = append(attachments, p)
+		}
+	})
+	if len(attachments) != 1 || attachments[0].Filename != "résume.pdf" || string(attachments[0].Body) != "%PDF-1.4\n" {
+		t.Errorf("unexpected attachments %#v", attachments)
+	}
+}
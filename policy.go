@@ -0,0 +1,211 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "fmt"
+import "net"
+import "time"
+
+// Action applied by the Client when the milter fails, like the Postfix
+// parameter milter_default_action.
+//
+// ▶︎ DA_ACCEPT : proceed as if the milter was not configured
+//
+// ▶︎ DA_TEMPFAIL : reject the message with a temporary error
+//
+// ▶︎ DA_REJECT : reject the message with a permanent error
+//
+// ▶︎ DA_QUARANTINE : accept the message and ask to hold it in quarantine.
+// The Exchange* functions return CONTINUE, so the caller reaches
+// ExchangeBodyEOB which returns ACCEPT with the quarantine request as
+// modification
+type DefaultAction int
+const (
+	DA_ACCEPT DefaultAction = iota
+	DA_TEMPFAIL
+	DA_REJECT
+	DA_QUARANTINE
+)
+
+// Display DefaultAction as string for debug purpose
+func (da *DefaultAction)String()(string) {
+	switch *da {
+	case DA_ACCEPT:     return "accept"
+	case DA_TEMPFAIL:   return "tempfail"
+	case DA_REJECT:     return "reject"
+	case DA_QUARANTINE: return "quarantine"
+	}
+	return fmt.Sprintf("default_action[%d]", int(*da))
+}
+
+// Convert the Postfix milter_default_action value ("accept", "tempfail",
+// "reject" or "quarantine") to DefaultAction.
+func ParseDefaultAction(value string)(DefaultAction, error) {
+	switch value {
+	case "accept":     return DA_ACCEPT, nil
+	case "tempfail":   return DA_TEMPFAIL, nil
+	case "reject":     return DA_REJECT, nil
+	case "quarantine": return DA_QUARANTINE, nil
+	}
+	return DA_TEMPFAIL, fmt.Errorf("unknown default action %q", value)
+}
+
+// This struct defines how the Client handles the milter failures. When the
+// field Policy of the Client is set, the connection errors, the timeouts
+// and the protocol errors are no longer returned by the Exchange*
+// functions. The failure is logged and recorded, see Client.Failure, and
+// the functions return the Action matching DefaultAction. Once failed, the
+// Client no longer talks with the milter and each Exchange* function
+// returns the default action immediately.
+//
+// The timeouts apply to each Exchange* function, a zero value means no
+// timeout:
+//
+// ▶︎ ConnectTimeout : connection to the milter, used by ClientNewPolicy
+//
+// ▶︎ CommandTimeout : OPTNEG, CONNECT, HELO, MAIL and RCPT
+//
+// ▶︎ ContentTimeout : HEADER, EOH, BODY and BODYEOB
+//
+// ▶︎ Timeouts : per-command timeout, it overrides the two previous values
+//
+// QuarantineReason is the reason sent with the quarantine request.
+type ClientPolicy struct {
+	DefaultAction DefaultAction
+	ConnectTimeout time.Duration
+	CommandTimeout time.Duration
+	ContentTimeout time.Duration
+	Timeouts map[MsgType]time.Duration
+	QuarantineReason string
+}
+
+// This function returns a policy with the Postfix defaults: tempfail, 30
+// seconds for connection and commands and 300 seconds for content.
+func ClientPolicyNew()(*ClientPolicy) {
+	return &ClientPolicy{
+		DefaultAction: DA_TEMPFAIL,
+		ConnectTimeout: 30 * time.Second,
+		CommandTimeout: 30 * time.Second,
+		ContentTimeout: 300 * time.Second,
+	}
+}
+
+// Returns the timeout of the command
+func (p *ClientPolicy)timeout(step MsgType)(time.Duration) {
+	var timeout time.Duration
+	var ok bool
+
+	timeout, ok = p.Timeouts[step]
+	if ok {
+		return timeout
+	}
+	switch step {
+	case SMFIC_HEADER, SMFIC_EOH, SMFIC_BODY, SMFIC_BODYEOB:
+		return p.ContentTimeout
+	}
+	return p.CommandTimeout
+}
+
+// Returns the synthesized action for the step. The quarantine is
+// requested at BODYEOB, so the message continues until this step.
+func (p *ClientPolicy)action(step MsgType)(*Action) {
+	switch p.DefaultAction {
+	case DA_ACCEPT:
+		return &Action{Action: AC_ACCEPT}
+	case DA_QUARANTINE:
+		if step != SMFIC_BODYEOB {
+			return &Action{Action: AC_CONTINUE}
+		}
+		return &Action{Action: AC_ACCEPT}
+	case DA_REJECT:
+		return &Action{Action: AC_REJECT}
+	}
+	return &Action{Action: AC_TEMPFAIL}
+}
+
+// Returns the synthesized modifications at BODYEOB
+func (p *ClientPolicy)modifications()([]*Modification) {
+	var reason string
+
+	if p.DefaultAction != DA_QUARANTINE {
+		return nil
+	}
+	reason = p.QuarantineReason
+	if reason == "" {
+		reason = "milter failure"
+	}
+	return []*Modification{&Modification{
+		Modification: MC_QUARANTINE,
+		Value: reason,
+	}}
+}
+
+// This function connects to milter server using a socket specification like
+// ClientNewSpec, and applies the policy. The ConnectTimeout of the policy
+// is used. This function never fails: if the connection fails, the
+// returned Client is already failed, so each Exchange* function returns
+// the default action. The connection error is available using
+// Client.Failure.
+func ClientNewPolicy(spec string, policy *ClientPolicy)(*Client) {
+	var cli *Client
+	var err error
+
+	cli, err = clientDial("", spec, policy.ConnectTimeout)
+	if err != nil {
+		cli = &Client{}
+		cli.Macros = MacroStoreNew()
+		cli.id = nextConnID()
+		cli.peer = spec
+		cli.Policy = policy
+		cli.failAction(SMFIC_OPTNEG, err)
+		return cli
+	}
+	cli.Policy = policy
+	return cli
+}
+
+// Returns the failure which triggered the default action, or nil if the
+// milter did not fail.
+func (cli *Client)Failure()(error) {
+	return cli.failure
+}
+
+// Arm the deadline of the command according with the policy. It returns
+// true if a deadline is set.
+func (cli *Client)armDeadline(step MsgType)(bool) {
+	var timeout time.Duration
+
+	if cli.Policy == nil {
+		return false
+	}
+	timeout = cli.Policy.timeout(step)
+	if timeout <= 0 {
+		return false
+	}
+	cli.buffer.Conn.SetDeadline(time.Now().Add(timeout))
+	return true
+}
+
+func (cli *Client)clearDeadline() {
+	cli.buffer.Conn.SetDeadline(time.Time{})
+}
+
+// Record the failure and returns the default action for the step. Without
+// policy, the error is returned.
+func (cli *Client)failAction(step MsgType, err error)(*Action, error) {
+	var netErr net.Error
+	var ok bool
+
+	if cli.Policy == nil {
+		return nil, err
+	}
+	if cli.failure == nil {
+		netErr, ok = err.(net.Error)
+		if ok && netErr.Timeout() {
+			err = fmt.Errorf("milter timeout: %s", err.Error())
+		}
+		cli.failure = err
+		cli.log(LL_WARNING, err, "milter failed, apply default action %s", cli.Policy.DefaultAction.String())
+	}
+	return cli.Policy.action(step), nil
+}
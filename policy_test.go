@@ -0,0 +1,225 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "net"
+import "strings"
+import "testing"
+import "time"
+
+// Start fake milter which negotiates, then answers the first command with
+// answer, or never answers if answer is nil.
+func testPolicyPipe(t *testing.T, policy *ClientPolicy, answer []byte)(*Client, func()) {
+	var cConn net.Conn
+	var sConn net.Conn
+	var cli *Client
+	var err error
+
+	cConn, sConn = net.Pipe()
+	go func() {
+		var b bufferIO
+		var err error
+
+		b.InitBufferIO(sConn)
+		_, err = b.ReceivePacket()
+		if err != nil {
+			return
+		}
+		b.Write(EncodeOptNeg(&MsgOptNeg{Version: MilterVersion}))
+		_, err = b.ReceivePacket()
+		if err != nil {
+			return
+		}
+		if answer != nil {
+			b.Write(answer)
+		}
+		b.ReceivePacket()
+	}()
+
+	cli = ClientNewFromConn(cConn)
+	cli.Policy = policy
+	_, err = cli.ExchangeOptNeg(&MsgOptNeg{Version: MilterVersion, Actions: SMFIF_ALL})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	return cli, func() {
+		cConn.Close()
+		sConn.Close()
+	}
+}
+
+func Test_clientPolicyTimeout(t *testing.T) {
+	var cli *Client
+	var done func()
+	var action *Action
+	var err error
+
+	cli, done = testPolicyPipe(t, &ClientPolicy{
+		DefaultAction: DA_TEMPFAIL,
+		CommandTimeout: 50 * time.Millisecond,
+	}, nil)
+	defer done()
+
+	action, err = cli.ExchangeConnect(&MsgConnect{Hostname: "mx", Family: SMFIA_INET, Port: 25, Address: "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("expect default action, got error %q", err.Error())
+	}
+	if action.Action != AC_TEMPFAIL {
+		t.Errorf("expect TEMPFAIL, got %s", action.Action.String())
+	}
+	if cli.Failure() == nil || !strings.Contains(cli.Failure().Error(), "timeout") {
+		t.Errorf("expect timeout failure, got %v", cli.Failure())
+	}
+
+	// The failed client answers without talking with the milter
+	action, err = cli.ExchangeHelo("mx.example.com")
+	if err != nil || action.Action != AC_TEMPFAIL {
+		t.Errorf("expect TEMPFAIL on failed client, got %v %v", action, err)
+	}
+}
+
+func Test_clientPolicyMacroTimeout(t *testing.T) {
+	var cli *Client
+	var done func()
+	var action *Action
+	var err error
+	var end chan struct{}
+
+	// Only MAIL has a timeout, the MACRO packet sent first must not hide it
+	cli, done = testPolicyPipe(t, &ClientPolicy{
+		DefaultAction: DA_TEMPFAIL,
+		Timeouts: map[MsgType]time.Duration{SMFIC_MAIL: 50 * time.Millisecond},
+	}, nil)
+	defer done()
+	cli.Macros.Add(MS_MAIL, "i", "4Fz1Yk0Xyz")
+
+	end = make(chan struct{})
+	go func() {
+		action, err = cli.ExchangeMail(&MsgMail{Address: "<a@example.com>"})
+		close(end)
+	}()
+	select {
+	case <-end:
+	case <-time.After(time.Second):
+		t.Fatalf("MAIL timeout not applied")
+	}
+	if err != nil || action.Action != AC_TEMPFAIL {
+		t.Errorf("expect TEMPFAIL, got %v %v", action, err)
+	}
+}
+
+func Test_clientPolicyBodyEOBTimeout(t *testing.T) {
+	var cConn net.Conn
+	var sConn net.Conn
+	var cli *Client
+	var mods []*Modification
+	var action *Action
+	var err error
+
+	// The milter sends each answer before the timeout, but the whole
+	// exchange exceeds it
+	cConn, sConn = net.Pipe()
+	defer cConn.Close()
+	defer sConn.Close()
+	go func() {
+		var b bufferIO
+
+		b.InitBufferIO(sConn)
+		b.ReceivePacket()
+		time.Sleep(60 * time.Millisecond)
+		b.Write(EncodeAddHeader(&MsgAddHeader{Name: "X-Test", Value: "yes"}))
+		time.Sleep(60 * time.Millisecond)
+		b.Write(EncodeAccept())
+		b.ReceivePacket()
+	}()
+
+	cli = ClientNewFromConn(cConn)
+	cli.Policy = &ClientPolicy{DefaultAction: DA_TEMPFAIL, ContentTimeout: 100 * time.Millisecond}
+	mods, action, err = cli.ExchangeBodyEOB()
+	if err != nil || action.Action != AC_TEMPFAIL || len(mods) != 0 {
+		t.Errorf("expect TEMPFAIL without modifications, got %v %v %v", mods, action, err)
+	}
+}
+
+func Test_clientPolicyProtocolError(t *testing.T) {
+	var cli *Client
+	var done func()
+	var action *Action
+	var err error
+
+	cli, done = testPolicyPipe(t, &ClientPolicy{DefaultAction: DA_REJECT}, EncodeOptNeg(&MsgOptNeg{Version: MilterVersion}))
+	defer done()
+
+	action, err = cli.ExchangeHelo("mx.example.com")
+	if err != nil {
+		t.Fatalf("expect default action, got error %q", err.Error())
+	}
+	if action.Action != AC_REJECT {
+		t.Errorf("expect REJECT, got %s", action.Action.String())
+	}
+	if cli.Failure() == nil || !strings.Contains(cli.Failure().Error(), "protocol error") {
+		t.Errorf("expect protocol error failure, got %v", cli.Failure())
+	}
+}
+
+func Test_clientPolicyConnect(t *testing.T) {
+	var cli *Client
+	var optNeg *MsgOptNeg
+	var action *Action
+	var mods []*Modification
+	var err error
+
+	cli = ClientNewPolicy("unix:/nonexistent/milter.sock", &ClientPolicy{
+		DefaultAction: DA_QUARANTINE,
+		QuarantineReason: "scanner down",
+	})
+	defer cli.Close()
+	if cli.Failure() == nil {
+		t.Fatalf("expect connection failure")
+	}
+
+	optNeg, err = cli.ExchangeOptNeg(&MsgOptNeg{Version: MilterVersion, Actions: SMFIF_ALL})
+	if err != nil || optNeg.Actions != 0 {
+		t.Errorf("expect options without actions, got %v %v", optNeg, err)
+	}
+
+	// The quarantine is requested at BODYEOB, the steps before continue
+	for _, exchange := range []func()(*Action, error){
+		func()(*Action, error) { return cli.ExchangeConnect(&MsgConnect{Hostname: "client.example", Family: SMFIA_INET, Port: 4567, Address: "192.0.2.1"}) },
+		func()(*Action, error) { return cli.ExchangeHelo("client.example") },
+		func()(*Action, error) { return cli.ExchangeMail(&MsgMail{Address: "<a@example.com>"}) },
+		func()(*Action, error) { return cli.ExchangeRcpt(&MsgMail{Address: "<b@example.net>"}) },
+		func()(*Action, error) { return cli.ExchangeHeader(&MsgHeader{Name: "Subject", Value: "test"}) },
+		func()(*Action, error) { return cli.ExchangeEOH() },
+		func()(*Action, error) { return cli.ExchangeBody([]byte("body\r\n")) },
+	} {
+		action, err = exchange()
+		if err != nil || action.Action != AC_CONTINUE {
+			t.Errorf("expect CONTINUE, got %v %v", action, err)
+		}
+	}
+	mods, action, err = cli.ExchangeBodyEOB()
+	if err != nil || action.Action != AC_ACCEPT {
+		t.Errorf("expect ACCEPT, got %v %v", action, err)
+	}
+	if len(mods) != 1 || mods[0].Modification != MC_QUARANTINE || mods[0].Value.(string) != "scanner down" {
+		t.Errorf("expect quarantine modification, got %v", mods)
+	}
+	if cli.SendHelo("mx") == nil {
+		t.Errorf("expect error sending on failed client")
+	}
+}
+
+func Test_parseDefaultAction(t *testing.T) {
+	var da DefaultAction
+	var err error
+
+	da, err = ParseDefaultAction("quarantine")
+	if err != nil || da != DA_QUARANTINE {
+		t.Errorf("expect quarantine, got %s %v", da.String(), err)
+	}
+	_, err = ParseDefaultAction("ignore")
+	if err == nil {
+		t.Errorf("expect error for unknown action")
+	}
+}
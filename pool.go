@@ -0,0 +1,349 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "errors"
+import "fmt"
+import "net"
+import "sync"
+import "time"
+
+// Default timeout used by the pool to connect the milters
+const DefaultPoolConnectTimeout = 30 * time.Second
+
+// Returned by ClientPool.Get when MaxSize connections are open
+var ErrPoolExhausted = errors.New("client pool exhausted")
+
+// This struct keeps negotiated connections to milters, keyed by socket
+// specification, so the connection and the option negotiation are not done
+// for each transaction. The connections are negotiated with OptNeg. Setup
+// is optional, it is called with each new *Client before the negotiation,
+// it is used to configure the client, like its Logger or its Policy.
+//
+// MaxSize is the maximum number of open connections per milter, in use or
+// idle. Zero means no limit. MinIdle is the number of idle connections kept
+// open per milter by Maintain. The idle connections are closed after
+// MaxIdleTime, zero means no limit.
+//
+// Put sends ABORT which resets the message state of the milter, so the
+// connection is ready for a new transaction. The milter keeps the
+// connection state, so the next user sends CONNECT and HELO again if they
+// differ. The connections which failed, even without policy, are closed,
+// never reused.
+type ClientPool struct {
+	OptNeg *MsgOptNeg
+	Setup func(*Client)
+	ConnectTimeout time.Duration
+	MaxSize int
+	MinIdle int
+	MaxIdleTime time.Duration
+
+	lock sync.Mutex
+	specs map[string]*poolSpec
+	closed bool
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Connections of one milter
+type poolSpec struct {
+	idle []*Client
+	open int
+}
+
+// Create new pool. The connections are negotiated with optNeg.
+func ClientPoolNew(optNeg *MsgOptNeg)(*ClientPool) {
+	return &ClientPool{
+		OptNeg: optNeg,
+		ConnectTimeout: DefaultPoolConnectTimeout,
+		specs: make(map[string]*poolSpec),
+	}
+}
+
+// Returns the connections of the spec, the pool must be locked.
+func (p *ClientPool)spec(spec string)(*poolSpec) {
+	var ps *poolSpec
+	var ok bool
+
+	ps, ok = p.specs[spec]
+	if !ok {
+		ps = &poolSpec{}
+		p.specs[spec] = ps
+	}
+	return ps
+}
+
+// Check idle connection without blocking. The milter sends nothing while
+// it is idle, so the read must time out. EOF or data means the connection
+// is no longer usable.
+func (cli *Client)healthy()(bool) {
+	var ne net.Error
+	var ok bool
+	var err error
+
+	cli.buffer.Conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err = cli.buffer.Reader.Peek(1)
+	cli.buffer.Conn.SetReadDeadline(time.Time{})
+	ne, ok = err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Returns true if the idle connection is expired
+func (p *ClientPool)expired(cli *Client, now time.Time)(bool) {
+	return p.MaxIdleTime > 0 && now.Sub(cli.idleSince) > p.MaxIdleTime
+}
+
+// Connect and negotiate new client. The slot is already reserved in open.
+func (p *ClientPool)dial(spec string)(*Client, error) {
+	var cli *Client
+	var optNeg MsgOptNeg
+	var err error
+
+	cli, err = clientDial("", spec, p.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cli.poolSpec = spec
+	if p.Setup != nil {
+		p.Setup(cli)
+	}
+	if p.OptNeg != nil {
+		optNeg = *p.OptNeg
+	} else {
+		optNeg = MsgOptNeg{Version: MilterVersion, Actions: SMFIF_ALL}
+	}
+	_, err = cli.ExchangeOptNeg(&optNeg)
+	if err == nil && cli.Failure() != nil {
+		err = cli.Failure()
+	}
+	if err != nil {
+		cli.Close()
+		return nil, err
+	}
+	return cli, nil
+}
+
+// Release the slot of closed connection
+func (p *ClientPool)release(spec string) {
+	p.lock.Lock()
+	p.spec(spec).open--
+	p.lock.Unlock()
+}
+
+// This function returns a negotiated client connected to the milter spec.
+// It reuses an idle connection if one is healthy, otherwise it opens a new
+// one. If MaxSize connections are already open, it returns
+// ErrPoolExhausted. The client must be returned with Put, or Discard if an
+// error occurs.
+func (p *ClientPool)Get(spec string)(*Client, error) {
+	var ps *poolSpec
+	var cli *Client
+	var now time.Time
+	var err error
+
+	for {
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			return nil, fmt.Errorf("client pool closed")
+		}
+		ps = p.spec(spec)
+		if len(ps.idle) == 0 {
+			break
+		}
+
+		// Most recently used connection first, the oldest expire
+		cli = ps.idle[len(ps.idle) - 1]
+		ps.idle = ps.idle[:len(ps.idle) - 1]
+		p.lock.Unlock()
+
+		now = time.Now()
+		if !p.expired(cli, now) && cli.healthy() {
+			return cli, nil
+		}
+		cli.Close()
+		p.release(spec)
+	}
+
+	if p.MaxSize > 0 && ps.open >= p.MaxSize {
+		p.lock.Unlock()
+		return nil, ErrPoolExhausted
+	}
+	ps.open++
+	p.lock.Unlock()
+
+	cli, err = p.dial(spec)
+	if err != nil {
+		p.release(spec)
+		return nil, err
+	}
+	return cli, nil
+}
+
+// This function returns the client to the pool. It sends ABORT and clears
+// the macros. If the client failed according with its policy, or saw an I/O
+// or protocol error, or ABORT can't be sent, the connection is closed.
+func (p *ClientPool)Put(cli *Client) {
+	var ps *poolSpec
+
+	if cli.Failure() != nil || cli.broken != nil || cli.ExchangeAbort() != nil {
+		p.Discard(cli)
+		return
+	}
+	cli.Macros.Reset()
+	cli.idleSince = time.Now()
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		p.Discard(cli)
+		return
+	}
+	ps = p.spec(cli.poolSpec)
+	ps.idle = append(ps.idle, cli)
+	p.lock.Unlock()
+}
+
+// This function closes the client and removes it from the pool. It is used
+// when an error occurs during the transaction.
+func (p *ClientPool)Discard(cli *Client) {
+	cli.Close()
+	p.release(cli.poolSpec)
+}
+
+// This function closes the idle connections expired or no longer healthy,
+// and opens connections until MinIdle idle connections are available for
+// each milter already used. It could be called periodically, see Start.
+func (p *ClientPool)Maintain() {
+	var specs []string
+	var spec string
+	var ps *poolSpec
+	var idle []*Client
+	var keep []*Client
+	var cli *Client
+	var now time.Time
+	var missing int
+	var err error
+
+	p.lock.Lock()
+	for spec = range p.specs {
+		specs = append(specs, spec)
+	}
+	p.lock.Unlock()
+
+	for _, spec = range specs {
+
+		// Check the idle connections outside of the lock
+		p.lock.Lock()
+		ps = p.spec(spec)
+		idle = ps.idle
+		ps.idle = nil
+		p.lock.Unlock()
+
+		now = time.Now()
+		keep = nil
+		for _, cli = range idle {
+			if !p.expired(cli, now) && cli.healthy() {
+				keep = append(keep, cli)
+				continue
+			}
+			cli.Close()
+			p.release(spec)
+		}
+
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			for _, cli = range keep {
+				p.Discard(cli)
+			}
+			continue
+		}
+		ps.idle = append(keep, ps.idle...)
+		missing = p.MinIdle - len(ps.idle)
+		if p.MaxSize > 0 && missing > p.MaxSize - ps.open {
+			missing = p.MaxSize - ps.open
+		}
+		if missing < 0 {
+			missing = 0
+		}
+		ps.open += missing
+		p.lock.Unlock()
+
+		for ; missing > 0; missing-- {
+			cli, err = p.dial(spec)
+			if err != nil {
+				p.release(spec)
+				continue
+			}
+			cli.idleSince = time.Now()
+			p.lock.Lock()
+			if p.closed {
+				p.lock.Unlock()
+				p.Discard(cli)
+				continue
+			}
+			ps.idle = append(ps.idle, cli)
+			p.lock.Unlock()
+		}
+	}
+}
+
+// This function starts a goroutine which calls Maintain every interval,
+// until Close.
+func (p *ClientPool)Start(interval time.Duration) {
+	p.lock.Lock()
+	if p.stop != nil || p.closed {
+		p.lock.Unlock()
+		return
+	}
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	p.lock.Unlock()
+
+	go func() {
+		var ticker *time.Ticker
+
+		defer close(p.done)
+		ticker = time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.Maintain()
+			}
+		}
+	}()
+}
+
+// This function closes the idle connections and stops the maintenance. The
+// clients in use are closed when they are returned.
+func (p *ClientPool)Close() {
+	var ps *poolSpec
+	var cli *Client
+	var idle []*Client
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return
+	}
+	p.closed = true
+	for _, ps = range p.specs {
+		idle = append(idle, ps.idle...)
+		ps.open -= len(ps.idle)
+		ps.idle = nil
+	}
+	p.lock.Unlock()
+
+	if p.stop != nil {
+		close(p.stop)
+		<-p.done
+	}
+	for _, cli = range idle {
+		cli.ExchangeQuit()
+		cli.Close()
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "io/ioutil"
+import "net"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync/atomic"
+import "testing"
+import "time"
+
+// Start service on unix socket, returns the socket spec and the stop function
+func testPoolService(t *testing.T, conns *int32)(string, func()) {
+	var svc *Service
+	var dir string
+	var spec string
+	var err error
+
+	dir, err = ioutil.TempDir("", "milter")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	spec = "unix:" + filepath.Join(dir, "pool.sock")
+	svc = ServiceNew(func()(ServerCallbacks) { return &testCallbacks{} })
+	svc.Setup = func(srv *Server) { atomic.AddInt32(conns, 1) }
+	err = svc.Listen(spec, nil)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	go svc.Serve()
+	return spec, func() {
+		svc.Shutdown(time.Second)
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_clientPool(t *testing.T) {
+	var pool *ClientPool
+	var spec string
+	var stop func()
+	var conns int32
+	var cli1 *Client
+	var cli2 *Client
+	var res *Result
+	var err error
+
+	spec, stop = testPoolService(t, &conns)
+	defer stop()
+	pool = ClientPoolNew(nil)
+	pool.MaxSize = 2
+	defer pool.Close()
+
+	cli1, err = pool.Get(spec)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	res, err = cli1.ProcessMessage(&Envelope{
+		Mail: &MsgMail{Address: "sender@example.org"},
+		Rcpts: []*MsgMail{&MsgMail{Address: "rcpt@example.net"}},
+	}, strings.NewReader("Subject: test\n\nbody\n"))
+	if err != nil || res.Step != SMFIC_BODYEOB {
+		t.Fatalf("unexpected result %v %v", res, err)
+	}
+	pool.Put(cli1)
+
+	// The idle connection is reused
+	cli2, err = pool.Get(spec)
+	if err != nil || cli2 != cli1 {
+		t.Errorf("expect reused connection, got %v", err)
+	}
+
+	// MaxSize is enforced
+	cli1, err = pool.Get(spec)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	_, err = pool.Get(spec)
+	if err == nil {
+		t.Errorf("expect exhausted pool")
+	}
+	pool.Discard(cli1)
+	pool.Put(cli2)
+	if atomic.LoadInt32(&conns) != 2 {
+		t.Errorf("expect 2 connections, got %d", atomic.LoadInt32(&conns))
+	}
+
+	// MinIdle opens the missing connections
+	pool.MinIdle = 2
+	pool.Maintain()
+	if len(pool.specs[spec].idle) != 2 || pool.specs[spec].open != 2 {
+		t.Errorf("expect 2 idle connections, got %d", len(pool.specs[spec].idle))
+	}
+}
+
+func Test_clientPoolHealth(t *testing.T) {
+	var cConn net.Conn
+	var sConn net.Conn
+	var cli *Client
+
+	cConn, sConn = net.Pipe()
+	cli = ClientNewFromConn(cConn)
+	if !cli.healthy() {
+		t.Errorf("expect idle connection healthy")
+	}
+	sConn.Close()
+	if cli.healthy() {
+		t.Errorf("expect closed connection not healthy")
+	}
+	cConn.Close()
+}
+
+func Test_clientPoolEviction(t *testing.T) {
+	var pool *ClientPool
+	var spec string
+	var stop func()
+	var conns int32
+	var cli1 *Client
+	var cli2 *Client
+	var err error
+
+	spec, stop = testPoolService(t, &conns)
+	defer stop()
+	pool = ClientPoolNew(nil)
+	pool.MaxIdleTime = 20 * time.Millisecond
+	defer pool.Close()
+
+	// The expired idle connection is closed and replaced
+	cli1, err = pool.Get(spec)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	pool.Put(cli1)
+	time.Sleep(30 * time.Millisecond)
+	cli2, err = pool.Get(spec)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if cli2 == cli1 || atomic.LoadInt32(&conns) != 2 || pool.specs[spec].open != 1 {
+		t.Errorf("expect expired connection replaced, got %d connections", atomic.LoadInt32(&conns))
+	}
+
+	// The unhealthy idle connection is closed and replaced
+	pool.Put(cli2)
+	cli2.buffer.Conn.Close()
+	cli1, err = pool.Get(spec)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if cli1 == cli2 || atomic.LoadInt32(&conns) != 3 || pool.specs[spec].open != 1 {
+		t.Errorf("expect unhealthy connection replaced, got %d connections", atomic.LoadInt32(&conns))
+	}
+
+	// The client which saw an I/O error is not reused, even without policy
+	cli1.buffer.Conn.SetReadDeadline(time.Now())
+	_, err = cli1.ExchangeHelo("mx.example.com")
+	if err == nil {
+		t.Fatalf("expect read timeout")
+	}
+	pool.Put(cli1)
+	if len(pool.specs[spec].idle) != 0 || pool.specs[spec].open != 0 {
+		t.Errorf("expect failed connection closed, got %d idle", len(pool.specs[spec].idle))
+	}
+}
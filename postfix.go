@@ -0,0 +1,115 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "fmt"
+import "net"
+import "strconv"
+
+// This struct contains SASL authentication information used to fill the
+// macros {auth_type}, {auth_authen} and {auth_author}.
+type MacroAuth struct {
+	Type string
+	Authen string
+	Author string
+}
+
+// This struct enables the automatic Postfix macros on Client. When the
+// field AutoMacros of the Client is set, the connection macros are filled
+// from the MsgConnect and Local before sending CONNECT, and the SASL macros
+// are filled from Auth before sending MAIL if Auth is not nil. Auth could be
+// set after the connection, once the SMTP client is authenticated. See
+// MacroFillPostfix for the list of macros.
+type PostfixMacros struct {
+	Local net.Addr
+	Auth *MacroAuth
+}
+
+// Split net.Addr into address and port
+func splitAddr(addr net.Addr)(string, string) {
+	var host string
+	var port string
+	var err error
+
+	switch a := addr.(type) {
+	case nil:
+		return "", ""
+	case *net.TCPAddr:
+		return a.IP.String(), strconv.Itoa(a.Port)
+	case *net.UnixAddr:
+		return a.Name, ""
+	}
+	host, port, err = net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), ""
+	}
+	return host, port
+}
+
+// This function fills the macros that Postfix sends from the connection
+// data, the local address and the authentication information. local and auth
+// could be nil. The filled macros are:
+//
+// ▶︎ CONNECT : _ {client_addr} {client_name} {client_ptr} {client_port}
+// {daemon_addr} {daemon_port}
+//
+// ▶︎ MAIL : {auth_type} {auth_authen} {auth_author}
+//
+// The client name is "unknown" if the hostname is empty, like Postfix does
+// for unresolved clients. The macros j, v, {daemon_name} and
+// {client_connections} depend on the MTA configuration, they must be set by
+// the caller.
+func (cli *Client)MacroFillPostfix(connect *MsgConnect, local net.Addr, auth *MacroAuth) {
+	var name string
+	var addr string
+	var port string
+
+	if connect != nil {
+		name = connect.Hostname
+		if name == "" {
+			name = "unknown"
+		}
+		cli.MacroAdd__(fmt.Sprintf("%s [%s]", name, connect.Address))
+		cli.MacroAdd_client_addr(connect.Address)
+		cli.MacroAdd_client_name(name)
+		cli.MacroAdd_client_ptr(name)
+		if connect.Family == SMFIA_INET || connect.Family == SMFIA_INET6 {
+			cli.MacroAdd_client_port(strconv.Itoa(connect.Port))
+		}
+	}
+
+	if local != nil {
+		addr, port = splitAddr(local)
+		cli.MacroAdd_daemon_addr(addr)
+		if port != "" {
+			cli.MacroAdd_daemon_port(port)
+		}
+	}
+
+	if auth != nil {
+		cli.fillAuthMacros(auth)
+	}
+}
+
+func (cli *Client)fillAuthMacros(auth *MacroAuth) {
+	cli.MacroAdd_auth_type(auth.Type)
+	cli.MacroAdd_auth_authen(auth.Authen)
+	if auth.Author != "" {
+		cli.MacroAdd_auth_author(auth.Author)
+	}
+}
+
+// Fill automatic macros for the step, if enabled
+func (cli *Client)autoMacros(step MsgType, connect *MsgConnect) {
+	if cli.AutoMacros == nil {
+		return
+	}
+	switch step {
+	case SMFIC_CONNECT:
+		cli.MacroFillPostfix(connect, cli.AutoMacros.Local, nil)
+	case SMFIC_MAIL:
+		if cli.AutoMacros.Auth != nil {
+			cli.fillAuthMacros(cli.AutoMacros.Auth)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "bufio"
+import "bytes"
+import "fmt"
+import "io"
+import "strings"
+
+// This struct contains the SMTP envelope of a message processed by
+// ProcessMessage. Connect and Helo are optional: they are sent only if they
+// are set, so many messages could be processed on the same connection by
+// setting them only for the first one. Mail and at least one recipient are
+// required.
+type Envelope struct {
+	Connect *MsgConnect
+	Helo string
+	Mail *MsgMail
+	Rcpts []*MsgMail
+}
+
+// Outcome of one recipient. Action is the milter answer to RCPT, Accepted
+// is false if the milter rejected the recipient.
+type RcptResult struct {
+	Rcpt *MsgMail
+	Action *Action
+	Accepted bool
+}
+
+// This struct is returned by ProcessMessage. Action is the final verdict and
+// Step is the command which produced it: SMFIC_BODYEOB if the whole message
+// was processed, or the command where the milter stopped the transaction.
+// If all the recipients are rejected, Action is the answer of the last
+// recipient and Step is SMFIC_RCPT. Rcpts contains the outcome of each
+// recipient in the envelope order. Modifications contains the
+// modifications returned at BODYEOB.
+type Result struct {
+	Action *Action
+	Step MsgType
+	Rcpts []*RcptResult
+	Modifications []*Modification
+}
+
+// Returns true if the action stops the processing of the message
+func stopsMessage(action *Action)(bool) {
+	return action.Action != AC_CONTINUE
+}
+
+// Read the header block of RFC 5322 message. The folded lines are joined
+// with "\n". If leadSpace is false, the whitespace after the colon is
+// removed, like the MTA does without SMFIP_HDR_LEADSPC.
+func readHeaders(br *bufio.Reader, leadSpace bool)([]*MsgHeader, error) {
+	var headers []*MsgHeader
+	var hdr *MsgHeader
+	var line string
+	var pos int
+	var err error
+
+	for {
+		line, err = br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return headers, nil
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(headers) == 0 {
+				return nil, fmt.Errorf("malformed header: continuation line without header")
+			}
+			headers[len(headers) - 1].Value += "\n" + line
+		} else {
+			pos = strings.IndexByte(line, ':')
+			if pos <= 0 {
+				return nil, fmt.Errorf("malformed header line %q", line)
+			}
+			hdr = &MsgHeader{Name: line[:pos], Value: line[pos + 1:]}
+			if !leadSpace {
+				hdr.Value = strings.TrimLeft(hdr.Value, " \t")
+			}
+			headers = append(headers, hdr)
+		}
+		if err == io.EOF {
+			return headers, nil
+		}
+	}
+}
+
+// This reader converts the line endings of the underlying reader to CRLF.
+type crlfReader struct {
+	br *bufio.Reader
+	pending []byte
+}
+
+func (c *crlfReader)Read(p []byte)(int, error) {
+	var line []byte
+	var n int
+	var err error
+
+	for len(c.pending) == 0 {
+		line, err = c.br.ReadBytes('\n')
+		if len(line) > 0 && line[len(line) - 1] == '\n' {
+			line = bytes.TrimSuffix(line[:len(line) - 1], []byte("\r"))
+			line = append(line, '\r', '\n')
+		}
+		c.pending = line
+		if err != nil {
+			if len(line) == 0 {
+				return 0, err
+			}
+			break
+		}
+	}
+	n = copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Send the body with CRLF line endings, using chunks of BodyChunkSize
+// bytes. It returns the first action which stops the message, or nil.
+func (cli *Client)processBody(br *bufio.Reader)(*Action, error) {
+	var chunk []byte
+	var cr *crlfReader
+	var n int
+	var action *Action
+	var err error
+	var rerr error
+
+	chunk = make([]byte, BodyChunkSize)
+	cr = &crlfReader{br: br}
+	for {
+		n, rerr = io.ReadFull(cr, chunk)
+		if n > 0 {
+			action, err = cli.ExchangeBody(chunk[:n])
+			if err != nil {
+				return nil, err
+			}
+			if stopsMessage(action) {
+				return action, nil
+			}
+		}
+		switch rerr {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return nil, nil
+		default:
+			return nil, rerr
+		}
+	}
+}
+
+// This function runs the whole milter transaction for the envelope env and
+// the RFC 5322 message msg, which contains the headers, an empty line and
+// the body. The option negotiation must be done before. The function sends
+// CONNECT and HELO if they are set in the envelope, MAIL, RCPT for each
+// recipient, each header, EOH, the body with CRLF line endings and BODYEOB.
+//
+// The steps declined by the milter during the negotiation are not sent, see
+// WantsStep. The header values keep their leading spaces if
+// SMFIP_HDR_LEADSPC was negotiated.
+//
+// The processing stops as soon as the milter answers something else than
+// CONTINUE, except for RCPT: a recipient rejection is recorded in the
+// result and the processing continues with the next recipient, unless all
+// the recipients are rejected. A DISCARD answered to RCPT discards the
+// whole message. An ACCEPT answered to RCPT accepts the whole message: the
+// milter is done with it, so the next recipients are accepted without being
+// sent and the result contains the ACCEPT at SMFIC_RCPT. If the processing
+// stops after MAIL was sent, ABORT is sent to the milter, so the connection
+// is ready for the next message.
+//
+// If the milter fails and the client has a policy, the result contains the
+// default action and, with DA_QUARANTINE, the quarantine request.
+//
+// If an error occurs, error is filled, and the connection should be closed.
+func (cli *Client)ProcessMessage(env *Envelope, msg io.Reader)(*Result, error) {
+	var res *Result
+	var br *bufio.Reader
+	var headers []*MsgHeader
+	var err error
+
+	if env.Mail == nil || len(env.Rcpts) == 0 {
+		return nil, fmt.Errorf("envelope requires sender and recipients")
+	}
+
+	// Read headers before starting the transaction, a malformed message
+	// must not start an exchange.
+	br = bufio.NewReader(msg)
+	headers, err = readHeaders(br, cli.optNeg != nil && cli.optNeg.Protocol & SMFIP_HDR_LEADSPC != 0)
+	if err != nil {
+		return nil, err
+	}
+
+	res = &Result{}
+	err = cli.processMessage(res, env, headers, br)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Run the transaction and fill res
+func (cli *Client)processMessage(res *Result, env *Envelope, headers []*MsgHeader, br *bufio.Reader)(error) {
+	var hdr *MsgHeader
+	var rcpt *MsgMail
+	var rres *RcptResult
+	var accepted int
+	var action *Action
+	var i int
+	var err error
+
+	// Connection level commands. The transaction is not started, so
+	// nothing is aborted.
+	if env.Connect != nil {
+		res.Step = SMFIC_CONNECT
+		res.Action, err = cli.ExchangeConnect(env.Connect)
+		if err != nil {
+			return err
+		}
+		if stopsMessage(res.Action) {
+			return nil
+		}
+	}
+	if env.Helo != "" {
+		res.Step = SMFIC_HELO
+		res.Action, err = cli.ExchangeHelo(env.Helo)
+		if err != nil {
+			return err
+		}
+		if stopsMessage(res.Action) {
+			return nil
+		}
+	}
+
+	res.Step = SMFIC_MAIL
+	res.Action, err = cli.ExchangeMail(env.Mail)
+	if err != nil {
+		return err
+	}
+	if stopsMessage(res.Action) {
+		return cli.ExchangeAbort()
+	}
+
+	// Each recipient could be rejected without stopping the message
+	for i, rcpt = range env.Rcpts {
+		action, err = cli.ExchangeRcpt(rcpt)
+		if err != nil {
+			return err
+		}
+		rres = &RcptResult{Rcpt: rcpt, Action: action}
+		switch action.Action {
+		case AC_CONTINUE:
+			rres.Accepted = true
+			accepted++
+		case AC_ACCEPT:
+			res.Step = SMFIC_RCPT
+			res.Action = action
+			res.Rcpts = append(res.Rcpts, &RcptResult{Rcpt: rcpt, Action: action, Accepted: true})
+			for _, rcpt = range env.Rcpts[i + 1:] {
+				res.Rcpts = append(res.Rcpts, &RcptResult{Rcpt: rcpt, Action: action, Accepted: true})
+			}
+			return cli.ExchangeAbort()
+		case AC_DISCARD:
+			res.Step = SMFIC_RCPT
+			res.Action = action
+			res.Rcpts = append(res.Rcpts, rres)
+			return cli.ExchangeAbort()
+		}
+		res.Rcpts = append(res.Rcpts, rres)
+		res.Step = SMFIC_RCPT
+		res.Action = action
+	}
+	if accepted == 0 {
+		return cli.ExchangeAbort()
+	}
+
+	res.Step = SMFIC_HEADER
+	for _, hdr = range headers {
+		res.Action, err = cli.ExchangeHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if stopsMessage(res.Action) {
+			return cli.ExchangeAbort()
+		}
+	}
+
+	res.Step = SMFIC_EOH
+	res.Action, err = cli.ExchangeEOH()
+	if err != nil {
+		return err
+	}
+	if stopsMessage(res.Action) {
+		return cli.ExchangeAbort()
+	}
+
+	res.Step = SMFIC_BODY
+	action, err = cli.processBody(br)
+	if err != nil {
+		return err
+	}
+	if action != nil {
+		res.Action = action
+		return cli.ExchangeAbort()
+	}
+
+	res.Step = SMFIC_BODYEOB
+	res.Modifications, res.Action, err = cli.ExchangeBodyEOB()
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "io"
+import "io/ioutil"
+import "strings"
+import "testing"
+
+// Rejects the recipients starting with "bad" and accepts the message on the
+// recipients starting with "accept"
+type testProcess struct {
+	testCallbacks
+}
+
+func (tp *testProcess)OnRCPT(srv *Server, mail *MsgMail)(*Action, error) {
+	if strings.HasPrefix(mail.Address, "bad") {
+		return ActionReject(), nil
+	}
+	if strings.HasPrefix(mail.Address, "accept") {
+		return ActionAccept(), nil
+	}
+	return ActionContinue(), nil
+}
+
+const testProcessMessage = "Subject: test\n" +
+                           "To: rcpt@example.net,\n" +
+                           "\tbad@example.net\n" +
+                           "\n" +
+                           "Hello\n" +
+                           "World\n"
+
+func Test_processMessage(t *testing.T) {
+	var tp *testProcess
+	var cli *Client
+	var done func()
+	var res *Result
+	var headers []*MsgHeader
+	var body []byte
+	var err error
+
+	tp = &testProcess{}
+	tp.onBODYEOB = func(srv *Server)([]*Modification, *Action, error) {
+		var r io.Reader
+
+		headers = srv.Transaction().Headers
+		r, _ = srv.Body()
+		body, _ = ioutil.ReadAll(r)
+		return []*Modification{ModificationAddHeader("X-Scanned", "yes")}, ActionAccept(), nil
+	}
+	cli, done = testPipe(t, tp, func(srv *Server) { srv.BodyBuffer = &BodyBuffer{} })
+	defer done()
+
+	res, err = cli.ProcessMessage(&Envelope{
+		Connect: &MsgConnect{Hostname: "client.example", Family: SMFIA_INET, Port: 4567, Address: "192.0.2.1"},
+		Helo: "client.example",
+		Mail: &MsgMail{Address: "sender@example.org"},
+		Rcpts: []*MsgMail{&MsgMail{Address: "rcpt@example.net"}, &MsgMail{Address: "bad@example.net"}},
+	}, strings.NewReader(testProcessMessage))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	if res.Step != SMFIC_BODYEOB || res.Action.Action != AC_ACCEPT {
+		t.Errorf("expect ACCEPT at BODYEOB, got %s at %s", res.Action.Action.String(), res.Step.String())
+	}
+	if len(res.Rcpts) != 2 || !res.Rcpts[0].Accepted || res.Rcpts[1].Accepted {
+		t.Errorf("expect first recipient accepted and second rejected, got %v", res.Rcpts)
+	}
+	if len(res.Modifications) != 1 || res.Modifications[0].Modification != MC_ADDHEADER {
+		t.Errorf("expect one ADDHEADER, got %v", res.Modifications)
+	}
+	if len(headers) != 2 || headers[1].Value != "rcpt@example.net,\n\tbad@example.net" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+	if string(body) != "Hello\r\nWorld\r\n" {
+		t.Errorf("expect CRLF body, got %q", string(body))
+	}
+}
+
+func Test_processMessageRejected(t *testing.T) {
+	var cli *Client
+	var done func()
+	var res *Result
+	var env *Envelope
+	var i int
+	var err error
+
+	cli, done = testPipe(t, &testProcess{}, nil)
+	defer done()
+
+	// The message is aborted, so the second one starts cleanly
+	env = &Envelope{
+		Mail: &MsgMail{Address: "sender@example.org"},
+		Rcpts: []*MsgMail{&MsgMail{Address: "bad1@example.net"}, &MsgMail{Address: "bad2@example.net"}},
+	}
+	for i = 0; i < 2; i++ {
+		res, err = cli.ProcessMessage(env, strings.NewReader(testProcessMessage))
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if res.Step != SMFIC_RCPT || res.Action.Action != AC_REJECT || len(res.Rcpts) != 2 {
+			t.Errorf("expect REJECT at RCPT, got %s at %s", res.Action.Action.String(), res.Step.String())
+		}
+	}
+
+	_, err = cli.ProcessMessage(env, strings.NewReader("no header line\n\nbody"))
+	if err == nil {
+		t.Errorf("expect malformed header error")
+	}
+}
+
+func Test_processMessageAcceptRcpt(t *testing.T) {
+	var tp *testProcess
+	var cli *Client
+	var done func()
+	var res *Result
+	var eob int
+	var err error
+
+	tp = &testProcess{}
+	tp.onBODYEOB = func(srv *Server)([]*Modification, *Action, error) {
+		eob++
+		return nil, ActionContinue(), nil
+	}
+	cli, done = testPipe(t, tp, nil)
+	defer done()
+
+	// ACCEPT at RCPT ends the message, the next recipient is not sent
+	res, err = cli.ProcessMessage(&Envelope{
+		Mail: &MsgMail{Address: "sender@example.org"},
+		Rcpts: []*MsgMail{&MsgMail{Address: "bad@example.net"}, &MsgMail{Address: "accept@example.net"}, &MsgMail{Address: "bad2@example.net"}},
+	}, strings.NewReader(testProcessMessage))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if res.Step != SMFIC_RCPT || res.Action.Action != AC_ACCEPT || eob != 0 {
+		t.Errorf("expect ACCEPT at RCPT without BODYEOB, got %s at %s", res.Action.Action.String(), res.Step.String())
+	}
+	if len(res.Rcpts) != 3 || res.Rcpts[0].Accepted || !res.Rcpts[1].Accepted ||
+	   !res.Rcpts[2].Accepted || res.Rcpts[2].Action.Action != AC_ACCEPT {
+		t.Errorf("unexpected recipient outcomes")
+	}
+
+	// The message was aborted, the next one is processed
+	res, err = cli.ProcessMessage(&Envelope{
+		Mail: &MsgMail{Address: "sender@example.org"},
+		Rcpts: []*MsgMail{&MsgMail{Address: "rcpt@example.net"}},
+	}, strings.NewReader(testProcessMessage))
+	if err != nil || res.Step != SMFIC_BODYEOB || eob != 1 {
+		t.Errorf("expect complete second message, got %v %v", res, err)
+	}
+}
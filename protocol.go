@@ -243,6 +243,9 @@ type ProtocolFlag uint32
 // ▶︎ SMFIP_NOHDRS : MTA not offer or milter don't want HEADER message
 //
 // ▶︎ SMFIP_NOEOH : MTA not offer or milter don't want EOH messages
+//
+// ▶︎ SMFIP_HDR_LEADSPC : MTA sends header values with their leading spaces.
+// This flag comes from protocol version 6, it is not part of SMFIP_ALL.
 const (
 	SMFIP_NOCONNECT ProtocolFlag = ProtocolFlag(0x01)
 	SMFIP_NOHELO ProtocolFlag = ProtocolFlag(0x02)
@@ -251,6 +254,7 @@ const (
 	SMFIP_NOBODY ProtocolFlag = ProtocolFlag(0x10)
 	SMFIP_NOHDRS ProtocolFlag = ProtocolFlag(0x20)
 	SMFIP_NOEOH ProtocolFlag = ProtocolFlag(0x40)
+	SMFIP_HDR_LEADSPC ProtocolFlag = ProtocolFlag(0x100000)
 	SMFIP_ALL ProtocolFlag = SMFIP_NOCONNECT | SMFIP_NOHELO | SMFIP_NOMAIL | SMFIP_NORCPT | SMFIP_NOBODY | SMFIP_NOHDRS | SMFIP_NOEOH
 )
 
@@ -265,6 +269,7 @@ func (p *ProtocolFlag)String()(string) {
 	if *p & SMFIP_NOBODY != 0    { flags = append(flags, "NOBODY") }
 	if *p & SMFIP_NOHDRS != 0    { flags = append(flags, "NOHDRS") }
 	if *p & SMFIP_NOEOH != 0     { flags = append(flags, "NOEOH") }
+	if *p & SMFIP_HDR_LEADSPC != 0 { flags = append(flags, "HDR_LEADSPC") }
 
 	return strings.Join(flags, "|")
 }
@@ -444,8 +449,8 @@ func (action *Action)String()(string) {
 // ▶︎ MC_DELRCPT : Delete recipient. The Value is a simple string which contains
 // recipient to delete.
 //
-// ▶︎ MC_REPLBODY : Replace email body. The Value is a simple string which
-// contains the new body.
+// ▶︎ MC_REPLBODY : Replace email body. The Value is a []byte which contains
+// the new body.
 //
 // ▶︎ MC_ADDHEADER : Add header in the email. The Value is a ModAddHeader
 // struct. Check documentation struct to understand how use it.
@@ -454,7 +459,8 @@ func (action *Action)String()(string) {
 // ModChgHeader struct. Check documentation struct to understand how use it.
 //
 // ▶︎ MC_QUARANTINE : Quarantine message. This quarantines the message into
-// a holding pool defined by the MTA.
+// a holding pool defined by the MTA. The Value is a simple string which
+// contains the reason.
 type Modification struct {
 	Modification ModificationCode
 	Value interface{}
@@ -464,15 +470,16 @@ type Modification struct {
 func (mod *Modification)String()(string) {
 	switch mod.Modification {
 	case MC_ADDRCPT,
-	     MC_DELRCPT,
-	     MC_REPLBODY:
+	     MC_DELRCPT:
 		return fmt.Sprintf("%s value=%s", mod.Modification.String(), qt(mod.Value.(string)))
+	case MC_REPLBODY:
+		return fmt.Sprintf("%s value=%s", mod.Modification.String(), qt(string(mod.Value.([]byte))))
 	case MC_ADDHEADER:
 		return fmt.Sprintf("%s %s", mod.Modification.String(), mod.Value.(*MsgAddHeader).String())
 	case MC_CHGHEADER:
 		return fmt.Sprintf("%s %s", mod.Modification.String(), mod.Value.(*MsgChgHeader).String())
 	case MC_QUARANTINE:
-		return fmt.Sprintf("%s", mod.Modification.String())
+		return fmt.Sprintf("%s reason=%s", mod.Modification.String(), qt(mod.Value.(string)))
 	}
 	return ""
 }
@@ -550,7 +557,7 @@ func DecodeLength(msg []byte)(uint, error) {
 //  SMFIR_ADDHEADER  : *MsgAddHeader
 //  SMFIR_CHGHEADER  : *MsgChgHeader
 //  SMFIR_PROGRESS   : nil
-//  SMFIR_QUARANTINE : nil
+//  SMFIR_QUARANTINE : string
 //  SMFIR_REJECT     : nil
 //  SMFIR_TEMPFAIL   : nil
 //  SMFIR_REPLYCODE  : *MsgReply
@@ -1283,7 +1290,7 @@ func EncodeHelo(helo string, macros []*Macro)([]byte) {
 	}
 
 	// Compute payload langth and make buffer with payload length
-	fillHeader(msg, SMFIC_HELO, data_length)
+	fillHeader(msg[pos:], SMFIC_HELO, data_length)
 	pos += headerLength
 
 	// Fill payload
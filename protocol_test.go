@@ -2,7 +2,9 @@
 
 package milter
 
+import "bytes"
 import "fmt"
+import "net"
 import "reflect"
 import "testing"
 
@@ -239,3 +241,144 @@ func Test_proto(t *testing.T) {
 		t.Errorf("%s", verdict)
 	}
 }
+
+// The commands sent with macros are preceded by a MACRO packet, each one
+// must decode with its own header.
+func Test_protoMacroPrefix(t *testing.T) {
+	var frames [][]byte
+	var verdict string
+	var macros []*Macro = []*Macro{
+		&Macro{
+			Step: MS_HELO,
+			Name: "{tls_version}",
+			Value: "TLSv1.3",
+		},
+	}
+
+	frames = splitFrames(EncodeHelo("my.host.name", macros))
+	if len(frames) != 2 {
+		t.Fatalf("Expect 2 packets, got %d", len(frames))
+	}
+	verdict = expect(frames[0], SMFIC_MACRO, macros)
+	if verdict != "" {
+		t.Errorf("%s", verdict)
+	}
+	verdict = expect(frames[1], SMFIC_HELO, "my.host.name")
+	if verdict != "" {
+		t.Errorf("%s", verdict)
+	}
+}
+
+// Each modification and action sent by the server must be received by the
+// client with the same value.
+func Test_roundTripAnswers(t *testing.T) {
+	var cConn net.Conn
+	var sConn net.Conn
+	var srv *Server
+	var cli *Client
+	var mods []*Modification
+	var mod *Modification
+	var decodedMod *Modification
+	var actions []*Action
+	var action *Action
+	var decodedAction *Action
+	var msgType MsgType
+	var value interface{}
+	var errs chan error
+	var err error
+
+	mods = []*Modification{
+		ModificationAddRcpt("<rcpt@example.net>"),
+		ModificationDelRcpt("<rcpt@example.net>"),
+		ModificationReplBody([]byte("new body\r\n")),
+		ModificationReplBody(bytes.Repeat([]byte("x"), BodyChunkSize)),
+		ModificationAddHeader("X-Header", "value"),
+		ModificationAddHeader("X-Folded", " leading space\r\n\tfolded"),
+		ModificationChgHeader(3, "Subject", "changed"),
+		ModificationDelHeader(1, "Received"),
+		ModificationQuarantine("suspect content"),
+		ModificationQuarantine(""),
+	}
+	actions = []*Action{
+		ActionAccept(),
+		ActionContinue(),
+		ActionDiscard(),
+		ActionReject(),
+		ActionTempfail(),
+		ActionReplyCode(550, "5.7.1 rejected"),
+		ActionReplyCode(451, "4.7.1 try again later"),
+	}
+
+	cConn, sConn = net.Pipe()
+	defer cConn.Close()
+	defer sConn.Close()
+	srv = ServerNew(sConn)
+	cli = ClientNewFromConn(cConn)
+	errs = make(chan error, 1)
+
+	for _, mod = range mods {
+
+		// Encode and Decode without network
+		msgType, value, err = Decode(encodeModification(t, mod)[4:])
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		decodedMod, err = AnswerToModification(msgType, value)
+		if err != nil || !reflect.DeepEqual(decodedMod, mod) {
+			t.Errorf("decode %s: got %v %v", mod.String(), decodedMod, err)
+		}
+
+		// Server to client
+		go func(mod *Modification) { errs <- srv.SendModification(mod) }(mod)
+		msgType, value, err = cli.ReceiveMessage()
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if <-errs != nil {
+			t.Fatalf("send %s failed", mod.String())
+		}
+		decodedMod, err = AnswerToModification(msgType, value)
+		if err != nil || !reflect.DeepEqual(decodedMod, mod) {
+			t.Errorf("round-trip %s: got %v %v", mod.String(), decodedMod, err)
+			continue
+		}
+		if decodedMod.String() != mod.String() {
+			t.Errorf("expect %s, got %s", mod.String(), decodedMod.String())
+		}
+	}
+
+	for _, action = range actions {
+		go func(action *Action) { errs <- srv.SendAction(action) }(action)
+		msgType, value, err = cli.ReceiveMessage()
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if <-errs != nil {
+			t.Fatalf("send %s failed", action.String())
+		}
+		decodedAction, err = AnswerToAction(msgType, value)
+		if err != nil || !reflect.DeepEqual(decodedAction, action) {
+			t.Errorf("round-trip %s: got %v %v", action.String(), decodedAction, err)
+		}
+
+		// An action is not a modification, and the reverse
+		_, err = AnswerToModification(msgType, value)
+		if err == nil {
+			t.Errorf("expect %s rejected as modification", action.String())
+		}
+	}
+}
+
+// Encode modification like Server.SendModification
+func encodeModification(t *testing.T, mod *Modification)([]byte) {
+	switch mod.Modification {
+	case MC_ADDRCPT:    return EncodeAddRcpt(mod.Value.(string))
+	case MC_DELRCPT:    return EncodeDelRcpt(mod.Value.(string))
+	case MC_REPLBODY:   return EncodeReplBody(mod.Value.([]byte))
+	case MC_ADDHEADER:  return EncodeAddHeader(mod.Value.(*MsgAddHeader))
+	case MC_CHGHEADER:  return EncodeChgHeader(mod.Value.(*MsgChgHeader))
+	case MC_QUARANTINE: return EncodeQuarantine(mod.Value.(string))
+	}
+	t.Fatalf("unknown modification %s", mod.Modification.String())
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "bytes"
+import "fmt"
+import "io"
+import "strings"
+import "time"
+
+// Convert the line breaks of header value to CRLF
+func crlfLines(value string)(string) {
+	value = strings.Replace(value, "\r\n", "\n", -1)
+	return strings.Replace(value, "\n", "\r\n", -1)
+}
+
+// This function writes the headers with CRLF line endings. If leadSpace is
+// true, the values contain their leading spaces as sent with
+// SMFIP_HDR_LEADSPC, otherwise one space is inserted after the colon like
+// the MTA does when it removes it.
+func writeHeaders(w io.Writer, headers []*MsgHeader, leadSpace bool) {
+	var h *MsgHeader
+
+	for _, h = range headers {
+		if leadSpace {
+			fmt.Fprintf(w, "%s:%s\r\n", h.Name, crlfLines(h.Value))
+		} else {
+			fmt.Fprintf(w, "%s: %s\r\n", h.Name, crlfLines(h.Value))
+		}
+	}
+}
+
+// Build a Received header like Postfix adds it before the content filters
+func (srv *Server)receivedHeader(now time.Time)(*MsgHeader) {
+	var b strings.Builder
+	var tx *Transaction
+	var by string
+	var id string
+	var host string
+
+	tx = &srv.transaction
+	b.WriteString("from ")
+	if tx.Helo != "" {
+		b.WriteString(tx.Helo)
+	} else {
+		b.WriteString("unknown")
+	}
+	if tx.Connect != nil {
+		host = tx.Connect.Hostname
+		if host == "" {
+			host = "unknown"
+		}
+		fmt.Fprintf(&b, " (%s [%s])", host, tx.Connect.Address)
+	}
+
+	_, by = srv.MacroGet("j")
+	if by == "" {
+		by = "localhost"
+	}
+	fmt.Fprintf(&b, "\n\tby %s with ESMTP", by)
+	_, id = srv.MacroGet("i")
+	if id != "" {
+		fmt.Fprintf(&b, " id %s", id)
+	}
+	if len(tx.Rcpts) == 1 {
+		fmt.Fprintf(&b, "\n\tfor %s", tx.Rcpts[0].Address)
+	}
+	fmt.Fprintf(&b, ";\n\t%s", now.Format("Mon, 2 Jan 2006 15:04:05 -0700 (MST)"))
+
+	return &MsgHeader{Name: "Received", Value: b.String()}
+}
+
+// This function returns the message received by the server, as expected by
+// content scanners: the headers in their received order with CRLF line
+// endings, the empty line and the body. The whitespace after the header
+// colon follows the negotiated SMFIP_HDR_LEADSPC. The body requires the
+// BodyBuffer, without it only the header block is returned. If received is
+// true, a synthetic Received header built from CONNECT, HELO, the macros
+// "j" and "i" and the recipient is prepended. The reader is valid until the
+// end of OnBODYEOB.
+func (srv *Server)RawMessage(received bool)(io.Reader, error) {
+	var header bytes.Buffer
+	var leadSpace bool
+	var body io.ReadSeeker
+	var err error
+
+	// The synthetic header always uses one space, the received headers
+	// follow the negotiation.
+	if received {
+		writeHeaders(&header, []*MsgHeader{srv.receivedHeader(time.Now())}, false)
+	}
+	leadSpace = srv.optNeg != nil && srv.optNeg.Protocol & SMFIP_HDR_LEADSPC != 0
+	writeHeaders(&header, srv.transaction.Headers, leadSpace)
+	header.WriteString("\r\n")
+
+	if srv.BodyBuffer == nil {
+		return &header, nil
+	}
+	body, err = srv.Body()
+	if err != nil {
+		return nil, err
+	}
+	return io.MultiReader(&header, body), nil
+}
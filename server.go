@@ -3,7 +3,9 @@
 package milter
 
 import "fmt"
+import "io"
 import "net"
+import "time"
 
 // Server Callbacks interface are used with Exchange() function.
 // Each callback is called when the client send corresponding message.
@@ -28,10 +30,27 @@ type ServerCallbacks interface {
 }
 
 // This struct contains server things like Macros. It allow
-// communication with client in Send*/Receive* mode.
+// communication with client in Send*/Receive* mode. Logger receives
+// the log records with a level lower or equal than LogLevel. Logger
+// is nil by default, so nothing is logged. If Metrics is set, the
+// server counts its packets and callback latencies in it.
 type Server struct {
 	buffer bufferIO
-	Macros []*Macro
+	Macros *MacroStore
+	Logger Logger
+	LogLevel LogLevel
+	id uint64
+	peer string
+	step MsgType
+	Metrics *Metrics
+	since time.Time
+	taps []Tap
+	transaction Transaction
+	BodyBuffer *BodyBuffer
+	stream *bodyStream
+	optNeg *MsgOptNeg
+	lifecycle lifecycle
+	cancel chan struct{}
 }
 
 // Create new server based on network connection.
@@ -40,12 +59,143 @@ func ServerNew(conn net.Conn)(*Server) {
 
 	/* Init new server */
 	srv = &Server{}
-	srv.Macros = nil
+	srv.Macros = MacroStoreNew()
+	srv.stream = &bodyStream{}
+	srv.id = nextConnID()
+	if conn.RemoteAddr() != nil {
+		srv.peer = conn.RemoteAddr().String()
+	}
 	srv.buffer.InitBufferIO(conn)
+	srv.buffer.observer = srv
 
 	return srv
 }
 
+// Returns the unique id of this server connection. This id is reported
+// in the log records.
+func (srv *Server)ConnID()(uint64) {
+	return srv.id
+}
+
+// Register tap which receives each packet sent or received, with its
+// decoded message. Taps must be registered before the exchange starts.
+func (srv *Server)AddTap(tap Tap) {
+	srv.taps = append(srv.taps, tap)
+}
+
+// Returns the options negotiated with the MTA, or nil before the
+// negotiation.
+func (srv *Server)OptNeg()(*MsgOptNeg) {
+	return srv.optNeg
+}
+
+// Returns the current protocol step. This is the last command received,
+// macros excepted.
+func (srv *Server)Step()(MsgType) {
+	return srv.step
+}
+
+// Returns a channel closed when TimeoutMiddleware stops waiting for the
+// running callback and answers the MTA in its place. The result of the
+// callback is then ignored, so it should return. Without TimeoutMiddleware,
+// the channel is nil, so it is never closed.
+func (srv *Server)Cancelled()(<-chan struct{}) {
+	return srv.cancel
+}
+
+// Returns a copy of the server for a callback running in its own goroutine.
+// The copy has its own macros and transaction, so Exchange could process
+// the next commands while the callback is running. It has no connection, so
+// the Send* functions return error.
+func (srv *Server)detach(cancel chan struct{})(*Server) {
+	return &Server{
+		Macros: srv.Macros.clone(),
+		Logger: srv.Logger,
+		LogLevel: srv.LogLevel,
+		id: srv.id,
+		peer: srv.peer,
+		step: srv.step,
+		Metrics: srv.Metrics,
+		transaction: *srv.transaction.clone(),
+		stream: srv.stream,
+		optNeg: srv.optNeg,
+		cancel: cancel,
+	}
+}
+
+func (srv *Server)newLogRecord(level LogLevel)(*LogRecord) {
+	var queueID string
+
+	_, queueID = srv.MacroGet("i")
+	return &LogRecord{
+		Time: time.Now(),
+		Level: level,
+		Side: "server",
+		ConnID: srv.id,
+		Peer: srv.peer,
+		Step: srv.step,
+		QueueID: queueID,
+	}
+}
+
+// Send record to the logger if the level is enabled.
+func (srv *Server)log(level LogLevel, err error, format string, args ...interface{}) {
+	var record *LogRecord
+
+	if srv.Logger == nil || level > srv.LogLevel {
+		return
+	}
+	record = srv.newLogRecord(level)
+	record.Message = fmt.Sprintf(format, args...)
+	record.Err = err
+	srv.Logger.Log(record)
+}
+
+// Implements frameObserver
+func (srv *Server)frame(dir Direction, frame []byte) {
+	var record *LogRecord
+
+	if dir == DIR_IN && len(frame) > 4 && toMsgType(frame[4]) != SMFIC_MACRO {
+		srv.step = toMsgType(frame[4])
+	}
+
+	if len(srv.taps) > 0 {
+		runTaps(srv.taps, "server", srv.id, dir, frame)
+	}
+
+	if srv.Metrics != nil {
+		srv.Metrics.observeFrame(dir, frame, srv.step, &srv.since)
+	}
+
+	if srv.Logger == nil || srv.LogLevel < LL_DEBUG {
+		return
+	}
+	record = srv.newLogRecord(srv.LogLevel)
+	if record.Level > LL_TRACE {
+		record.Level = LL_TRACE
+	}
+	record.Direction = dir
+	logMessage(srv.Logger, record, frame)
+}
+
+// Count protocol error in metrics and returns it
+func (srv *Server)protocolError(err error)(error) {
+	if srv.Metrics != nil {
+		srv.Metrics.protocolError()
+	}
+	return err
+}
+
+// Log the error and forward it to OnERROR callback
+func (srv *Server)fail(inst ServerCallbacks, err error) {
+	if err == io.EOF {
+		srv.log(LL_INFO, nil, "connection closed by client")
+	} else {
+		srv.log(LL_ERROR, err, "session aborted")
+	}
+	inst.OnERROR(srv, err)
+}
+
 // This function returns milter byte ready to be decoded
 // If error is filled, the connexion should be close and processing aborted
 func (srv *Server)ReceivePacket()([]byte, error) {
@@ -57,6 +207,8 @@ func (srv *Server)ReceivePacket()([]byte, error) {
 // If error is filled, the connexion should be close and processing aborted
 func (srv *Server)ReceiveMessage()(MsgType, interface{}, error) {
 	var msg []byte
+	var msgType MsgType
+	var value interface{}
 	var err error
 
 	msg, err = srv.buffer.ReceivePacket()
@@ -64,7 +216,11 @@ func (srv *Server)ReceiveMessage()(MsgType, interface{}, error) {
 		return SMFIR_ERROR, nil, err
 	}
 
-	return Decode(msg)
+	msgType, value, err = Decode(msg)
+	if err != nil {
+		return msgType, value, srv.protocolError(err)
+	}
+	return msgType, value, nil
 }
 
 // This function is called to handle new server request. "inst" is a variable
@@ -75,104 +231,122 @@ func (srv *Server)ReceiveMessage()(MsgType, interface{}, error) {
 // close connection. If the function returns 1, the connection should be keep
 // opened and a new request could arrive.
 func Exchange(conn net.Conn, inst ServerCallbacks) {
-	var srv *Server
+	ExchangeServer(ServerNew(conn), inst)
+}
+
+// This function is the same than Exchange, but it uses a *Server created by
+// the caller with ServerNew. This allow the caller to configure the server
+// before the first message is read.
+func ExchangeServer(srv *Server, inst ServerCallbacks) {
 	var msgType MsgType
 	var msg interface{}
 	var err error
 	var macros []*Macro
-	var m *Macro
 	var optNeg *MsgOptNeg
 	var modification *Modification
 	var modifications []*Modification
 	var action *Action
 
-	/* Init new server */
-	srv = ServerNew(conn)
-	srv.Macros = nil
+	srv.log(LL_INFO, nil, "new connection")
+	srv.lifecycle.hooks, _ = inst.(LifecycleCallbacks)
+	srv.lifecycle.connectionOpen(srv)
+	defer srv.lifecycle.connectionClose(srv)
+	defer srv.resetBody()
+	defer srv.stream.abort()
 
 	/* Read first message, expect Optneg */
 	msgType, msg, err = srv.ReceiveMessage()
 	if err != nil {
-		inst.OnERROR(srv, err)
+		srv.fail(inst, err)
 		return
 	}
 
 	/* Expect negociation */
 	if msgType != SMFIC_OPTNEG {
-		inst.OnERROR(srv, fmt.Errorf("protocol error: expect message SMFIC_OPTNEG, got %s", msgType.String()))
+		srv.fail(inst, srv.protocolError(fmt.Errorf("protocol error: expect message SMFIC_OPTNEG, got %s", msgType.String())))
 		return
 	}
 
 	// Call OptNeg callback
 	optNeg, err = inst.OnOPTNEG(srv, msg.(*MsgOptNeg))
 	if err != nil {
-		inst.OnERROR(srv, err)
+		srv.fail(inst, err)
 		return
 	}
 
 	err = srv.buffer.Write(EncodeOptNeg(optNeg))
 	if err != nil {
-		inst.OnERROR(srv, err)
+		srv.fail(inst, err)
 		return
 	}
+	srv.optNeg = optNeg
 
 	for {
 
 		// Read next message
+		action = nil
 		msgType, msg, err = srv.ReceiveMessage()
 		if err != nil {
-			inst.OnERROR(srv, err)
+			srv.fail(inst, err)
 			return
 		}
 
+		// Record message in the transaction
+		srv.transaction.record(msgType, msg)
+		if msgType == SMFIC_MAIL {
+			srv.lifecycle.messageStart(srv)
+		}
+
 		// Call the right callback according with received message
 		switch msgType {
 		case SMFIC_CONNECT:
 
 			action, err = inst.OnCONNECT(srv, msg.(*MsgConnect))
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
 			err = srv.SendAction(action)
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
 		case SMFIC_MACRO:
 
 			macros = msg.([]*Macro)
-			for _, m = range macros {
-				macroAdd(&srv.Macros, m.Step, m.Name, m.Value)
+			if len(macros) > 0 {
+				srv.Macros.SetStep(macros[0].Step, macros)
 			}
 
 		case SMFIC_HELO:
 
 			action, err = inst.OnHELO(srv, msg.(string))
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
 			err = srv.SendAction(action)
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
 		case SMFIC_MAIL:
 
+			srv.resetBody()
+			srv.stream.abort()
 			action, err = inst.OnMAIL(srv, msg.(*MsgMail))
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
 			err = srv.SendAction(action)
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
@@ -180,13 +354,14 @@ func Exchange(conn net.Conn, inst ServerCallbacks) {
 
 			action, err = inst.OnRCPT(srv, msg.(*MsgMail))
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
+			srv.transaction.rcptAction(action)
 
 			err = srv.SendAction(action)
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
@@ -194,13 +369,13 @@ func Exchange(conn net.Conn, inst ServerCallbacks) {
 
 			action, err = inst.OnHEADER(srv, msg.(*MsgHeader))
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
 			err = srv.SendAction(action)
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
@@ -208,91 +383,155 @@ func Exchange(conn net.Conn, inst ServerCallbacks) {
 
 			action, err = inst.OnEOH(srv)
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
 			err = srv.SendAction(action)
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
 		case SMFIC_BODY:
 
-			action, err = inst.OnBODY(srv, msg.([]byte))
+			action, err = srv.bufferBody(inst, msg.([]byte))
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
 			err = srv.SendAction(action)
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
 		case SMFIC_BODYEOB:
 
-			modifications, action, err = inst.OnBODYEOB(srv)
+			modifications, action, err = srv.callBodyEOB(inst)
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
 			for _, modification = range modifications {
 				err = srv.SendModification(modification)
 				if err != nil {
-					inst.OnERROR(srv, err)
+					srv.fail(inst, err)
 					return
 				}
 			}
 
 			err = srv.SendAction(action)
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
 			/* could proces other message */
-			srv.Macros = nil
+			srv.Macros.ClearMessage()
+			srv.transaction.resetMessage()
+			srv.resetBody()
 
 		case SMFIC_ABORT:
 
+			srv.stream.abort()
 			err = inst.OnABORT(srv)
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
 
 			/* Abort command must reset transaction to the step HELO */
-			srv.Macros = nil
+			srv.lifecycle.messageEnd(srv, ME_ABORTED)
+			srv.Macros.ClearMessage()
+			srv.transaction.resetMessage()
+			srv.resetBody()
 
 		case SMFIC_QUIT:
 
 			err = inst.OnQUIT(srv)
 			if err != nil {
-				inst.OnERROR(srv, err)
+				srv.fail(inst, err)
 				return
 			}
+			srv.log(LL_INFO, nil, "connection closed")
 			return
 
 		default:
-			inst.OnERROR(srv, fmt.Errorf("receive unknown response code %q: %s", string(byte(msgType)), msgType.String()))
+			srv.fail(inst, srv.protocolError(fmt.Errorf("receive unknown response code %q: %s", string(byte(msgType)), msgType.String())))
 			return
 		}
+
+		// Check if the answer ends the message
+		srv.lifecycle.stepDone(srv, msgType, action)
+	}
+}
+
+// Accumulate body chunk if BodyBuffer is enabled, and call OnBODY. If the
+// maximum size is exceeded, the callback is not called.
+func (srv *Server)bufferBody(inst ServerCallbacks, body []byte)(*Action, error) {
+	var ok bool
+	var err error
+
+	if srv.BodyBuffer == nil {
+		return srv.callBody(inst, body)
+	}
+	ok, err = srv.BodyBuffer.write(body)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		srv.log(LL_INFO, nil, "body size exceeds %d bytes", srv.BodyBuffer.MaxSize)
+		return srv.BodyBuffer.maxSizeAction(), nil
+	}
+	return srv.callBody(inst, body)
+}
+
+// Call OnBODY, or write the chunk in the body stream if the callbacks
+// implement BodyStreamer.
+func (srv *Server)callBody(inst ServerCallbacks, body []byte)(*Action, error) {
+	var streamer BodyStreamer
+	var ok bool
+
+	streamer, ok = inst.(BodyStreamer)
+	if ok {
+		srv.stream.write(srv, streamer, body)
+		return ActionContinue(), nil
+	}
+	return inst.OnBODY(srv, body)
+}
+
+// Call OnBODYEOB, or close the body stream and returns the result of
+// OnBODYSTREAM if the callbacks implement BodyStreamer.
+func (srv *Server)callBodyEOB(inst ServerCallbacks)([]*Modification, *Action, error) {
+	var streamer BodyStreamer
+	var ok bool
+
+	streamer, ok = inst.(BodyStreamer)
+	if ok {
+		return srv.stream.end(srv, streamer)
+	}
+	return inst.OnBODYEOB(srv)
+}
+
+// Release the body accumulated
+func (srv *Server)resetBody() {
+	if srv.BodyBuffer != nil {
+		srv.BodyBuffer.reset()
 	}
 }
 
 // This function perform a lookup in the macro container. It returns macro value
 // or empty string if none is found
 func (srv *Server)MacroGet(name string)(MacroStep, string) {
-	return macroGet(srv.Macros, name)
+	return srv.Macros.Get(name)
 }
 
 // Display Macro summary on stdout.
 func (srv *Server)MacroDebug()() {
-	macroDebug(srv.Macros)
+	srv.Macros.Debug()
 }
 
 // Send OPTNEG message
@@ -0,0 +1,169 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "errors"
+import "fmt"
+import "net"
+import "sync"
+import "syscall"
+import "time"
+
+// This struct runs a milter server on one or more listeners. Each accepted
+// connection is processed by the Exchange loop in its own goroutine.
+// NewCallbacks is called for each new connection and must return the
+// ServerCallbacks which handle this connection. Setup is optional, it is
+// called with each new *Server before the Exchange loop starts. It is
+// used to configure the server, like its Logger.
+type Service struct {
+	NewCallbacks func()(ServerCallbacks)
+	Setup func(*Server)
+	Listeners []*Listener
+
+	lock sync.Mutex
+	sessions sync.WaitGroup
+	closing bool
+}
+
+// Create new service. newCallbacks is called for each accepted connection.
+func ServiceNew(newCallbacks func()(ServerCallbacks))(*Service) {
+	return &Service{NewCallbacks: newCallbacks}
+}
+
+// Open new listener according with socket specification and add it to the
+// service. See Listen for more information.
+func (svc *Service)Listen(spec string, opts *ListenOptions)(error) {
+	var l *Listener
+	var err error
+
+	l, err = Listen(spec, opts)
+	if err != nil {
+		return err
+	}
+	svc.Listeners = append(svc.Listeners, l)
+	return nil
+}
+
+// This function accepts connections on all the listeners. It blocks until the
+// listeners are closed. If Shutdown was called, the function returns nil,
+// otherwise it returns the first accept error.
+func (svc *Service)Serve()(error) {
+	var l *Listener
+	var wg sync.WaitGroup
+	var errs chan error
+	var err error
+
+	if len(svc.Listeners) == 0 {
+		return fmt.Errorf("no listener to serve")
+	}
+
+	errs = make(chan error, len(svc.Listeners))
+	for _, l = range svc.Listeners {
+		wg.Add(1)
+		go func(l *Listener) {
+			defer wg.Done()
+			errs <- svc.serveListener(l)
+		}(l)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err = range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (svc *Service)serveListener(l *Listener)(error) {
+	var conn net.Conn
+	var err error
+
+	for {
+		conn, err = l.Accept()
+		if err != nil {
+			if svc.isClosing() {
+				return nil
+			}
+			if acceptRetry(err) {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		svc.sessions.Add(1)
+		go func(conn net.Conn) {
+			var srv *Server
+
+			defer svc.sessions.Done()
+			srv = ServerNew(conn)
+			if svc.Setup != nil {
+				svc.Setup(srv)
+			}
+			ExchangeServer(srv, svc.NewCallbacks())
+			conn.Close()
+		}(conn)
+	}
+}
+
+// Returns true if the accept error is transient, like the exhaustion of
+// file descriptors, so the listener is still usable.
+func acceptRetry(err error)(bool) {
+	var ne net.Error
+	var errno syscall.Errno
+
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		     syscall.ECONNABORTED, syscall.EINTR:
+			return true
+		}
+	}
+	return false
+}
+
+func (svc *Service)isClosing()(bool) {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	return svc.closing
+}
+
+// This function stops accepting new connections and waits for the end of
+// running sessions. The sessions are not interrupted, so the MTA connections
+// are processed until their end. If timeout is reached, the function returns
+// error and the sessions still run. A timeout of 0 waits forever.
+func (svc *Service)Shutdown(timeout time.Duration)(error) {
+	var l *Listener
+	var done chan struct{}
+
+	svc.lock.Lock()
+	svc.closing = true
+	svc.lock.Unlock()
+
+	for _, l = range svc.Listeners {
+		l.Close()
+	}
+
+	done = make(chan struct{})
+	go func() {
+		svc.sessions.Wait()
+		close(done)
+	}()
+
+	if timeout == 0 {
+		<-done
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("shutdown timeout: sessions still running")
+	}
+}
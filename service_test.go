@@ -0,0 +1,79 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "os"
+import "path/filepath"
+import "syscall"
+import "testing"
+import "time"
+
+func Test_serviceShutdown(t *testing.T) {
+	var svc *Service
+	var l *Listener
+	var path string
+	var served chan error
+	var cli *Client
+	var err error
+
+	svc = ServiceNew(func()(ServerCallbacks) { return &testCallbacks{} })
+	if svc.Serve() == nil {
+		t.Errorf("expect error without listener")
+	}
+
+	l, path = testListen(t, "milter.sock")
+	defer os.RemoveAll(filepath.Dir(path))
+	svc.Listeners = append(svc.Listeners, l)
+	served = make(chan error, 1)
+	go func() {
+		served <- svc.Serve()
+	}()
+
+	cli, err = ClientNewSpec("unix:" + path, 1)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	_, err = cli.ExchangeOptNeg(&MsgOptNeg{Version: MilterVersion, Actions: SMFIF_ALL})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// The running session is not interrupted
+	err = svc.Shutdown(50 * time.Millisecond)
+	if err == nil {
+		t.Errorf("expect shutdown timeout with running session")
+	}
+	select {
+	case err = <-served:
+		if err != nil {
+			t.Errorf("expect Serve returns nil after Shutdown, got %s", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Serve still running after Shutdown")
+	}
+	_, err = cli.ExchangeHelo("mx.example.com")
+	if err != nil {
+		t.Errorf("expect running session served, got %s", err.Error())
+	}
+
+	// Shutdown completes at the end of the session
+	cli.ExchangeQuit()
+	cli.Close()
+	err = svc.Shutdown(time.Second)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Errorf("expect socket file removed")
+	}
+}
+
+func Test_acceptRetry(t *testing.T) {
+	if !acceptRetry(&os.SyscallError{Syscall: "accept", Err: syscall.EMFILE}) {
+		t.Errorf("expect retry on EMFILE")
+	}
+	if acceptRetry(&os.SyscallError{Syscall: "accept", Err: syscall.EBADF}) {
+		t.Errorf("expect no retry on EBADF")
+	}
+}
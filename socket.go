@@ -0,0 +1,310 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "fmt"
+import "net"
+import "os"
+import "os/user"
+import "strconv"
+import "strings"
+
+// This struct contains a decoded milter socket specification. Family is one
+// of "unix", "inet" or "inet6". Path is filled for "unix" family, Host and
+// Port are filled for "inet" and "inet6" families. Host may be empty, which
+// means any address.
+type SocketSpec struct {
+	Family string
+	Path string
+	Host string
+	Port int
+}
+
+// Display SocketSpec as string. The output uses Sendmail syntax and could be
+// parsed again with ParseSocketSpec.
+func (s *SocketSpec)String()(string) {
+	switch s.Family {
+	case "unix":
+		return "unix:" + s.Path
+	case "inet6":
+		if s.Host == "" {
+			return fmt.Sprintf("inet6:%d", s.Port)
+		}
+		return fmt.Sprintf("inet6:%d@[%s]", s.Port, s.Host)
+	default:
+		if s.Host == "" {
+			return fmt.Sprintf("inet:%d", s.Port)
+		}
+		return fmt.Sprintf("inet:%d@%s", s.Port, s.Host)
+	}
+}
+
+// Returns the network name expected by the Go net package: "unix", "tcp4"
+// or "tcp6".
+func (s *SocketSpec)Network()(string) {
+	switch s.Family {
+	case "unix":  return "unix"
+	case "inet6": return "tcp6"
+	default:      return "tcp4"
+	}
+}
+
+// Returns the address expected by the Go net package, like
+// "/var/run/milter.sock", "127.0.0.1:8891" or "[::1]:8891".
+func (s *SocketSpec)Address()(string) {
+	if s.Family == "unix" {
+		return s.Path
+	}
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// This function parse socket specification like Sendmail and Postfix do.
+// Accepted formats are:
+//
+// ▶︎ unix:/path/to/socket or local:/path/to/socket : Unix socket
+//
+// ▶︎ inet:port@host or inet:host:port or inet:port : IPv4 socket. Without host
+// the socket binds all addresses.
+//
+// ▶︎ inet6:port@host or inet6:port@[host] or inet6:[host]:port : IPv6 socket.
+//
+// A string without prefix which starts with "/" is a unix socket. If the
+// specification is not valid, error is filled.
+func ParseSocketSpec(spec string)(*SocketSpec, error) {
+	var s *SocketSpec
+	var family string
+	var addr string
+	var port string
+	var err error
+	var i int
+
+	// Split family and address
+	i = strings.Index(spec, ":")
+	if i == -1 {
+		if strings.HasPrefix(spec, "/") {
+			return &SocketSpec{Family: "unix", Path: spec}, nil
+		}
+		return nil, fmt.Errorf("socket spec %q: expect family prefix like \"unix:\" or \"inet:\"", spec)
+	}
+	family = strings.ToLower(spec[:i])
+	addr = spec[i+1:]
+
+	s = &SocketSpec{}
+	switch family {
+	case "unix", "local":
+		if addr == "" {
+			return nil, fmt.Errorf("socket spec %q: empty path", spec)
+		}
+		s.Family = "unix"
+		s.Path = addr
+		return s, nil
+
+	case "inet", "inet6":
+		s.Family = family
+
+		// Sendmail syntax port@host, Postfix syntax host:port, or only port
+		i = strings.Index(addr, "@")
+		if i != -1 {
+			port = addr[:i]
+			s.Host = addr[i+1:]
+		} else if strings.Contains(addr, ":") {
+			s.Host, port, err = net.SplitHostPort(addr)
+			if err != nil {
+				return nil, fmt.Errorf("socket spec %q: %s", spec, err.Error())
+			}
+		} else {
+			port = addr
+		}
+
+		// Remove optional brackets around IPv6 address
+		if strings.HasPrefix(s.Host, "[") && strings.HasSuffix(s.Host, "]") {
+			s.Host = s.Host[1:len(s.Host)-1]
+		}
+
+		s.Port, err = strconv.Atoi(port)
+		if err != nil || s.Port < 0 || s.Port > 65535 {
+			return nil, fmt.Errorf("socket spec %q: invalid port %q", spec, port)
+		}
+		return s, nil
+
+	default:
+		return nil, fmt.Errorf("socket spec %q: unknown family %q", spec, family)
+	}
+}
+
+// This struct contains options applied by Listen on unix sockets. They are
+// ignored for inet and inet6 sockets. Mode is the file permission, zero keeps
+// the default permission. Owner and Group are user and group names or numeric
+// ids, empty string keeps the default value.
+type ListenOptions struct {
+	Mode os.FileMode
+	Owner string
+	Group string
+}
+
+// This struct is a net.Listener built from a socket specification. For unix
+// sockets, the socket file is removed when the listener is closed. Name is
+// the name given by systemd in LISTEN_FDNAMES for inherited listeners.
+type Listener struct {
+	net.Listener
+	Spec *SocketSpec
+	Name string
+	path string
+}
+
+// Close the listener. For unix socket, the socket file is removed.
+func (l *Listener)Close()(error) {
+	var err error
+
+	err = l.Listener.Close()
+	if l.path != "" {
+		os.Remove(l.path)
+		l.path = ""
+	}
+	return err
+}
+
+// Remove unix socket file if it is not used by another process. The function
+// returns an error if the file exists and it is not a socket, or if another
+// process accepts connections on it.
+func removeStaleSocket(path string)(error) {
+	var info os.FileInfo
+	var conn net.Conn
+	var err error
+
+	info, err = os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode() & os.ModeSocket == 0 {
+		return fmt.Errorf("%s: file exists and it is not a socket", path)
+	}
+
+	// Somebody listen on this socket, do not steal it
+	conn, err = net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: socket already in use", path)
+	}
+
+	return os.Remove(path)
+}
+
+func lookupId(name string, lookup func(string)(string, error))(int, error) {
+	var id int
+	var err error
+	var str string
+
+	id, err = strconv.Atoi(name)
+	if err == nil {
+		return id, nil
+	}
+	str, err = lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(str)
+}
+
+func lookupUid(name string)(string, error) {
+	var u *user.User
+	var err error
+
+	u, err = user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGid(name string)(string, error) {
+	var g *user.Group
+	var err error
+
+	g, err = user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// Apply mode, owner and group on unix socket file.
+func applyListenOptions(path string, opts *ListenOptions)(error) {
+	var uid int = -1
+	var gid int = -1
+	var err error
+
+	if opts == nil {
+		return nil
+	}
+
+	if opts.Mode != 0 {
+		err = os.Chmod(path, opts.Mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Owner != "" {
+		uid, err = lookupId(opts.Owner, lookupUid)
+		if err != nil {
+			return fmt.Errorf("owner %q: %s", opts.Owner, err.Error())
+		}
+	}
+	if opts.Group != "" {
+		gid, err = lookupId(opts.Group, lookupGid)
+		if err != nil {
+			return fmt.Errorf("group %q: %s", opts.Group, err.Error())
+		}
+	}
+	if uid != -1 || gid != -1 {
+		err = os.Chown(path, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// This function opens a listener according with socket specification. See
+// ParseSocketSpec for accepted formats. For unix socket, the stale socket file
+// is removed before listening and the options are applied on the new socket
+// file. opts could be nil.
+func Listen(spec string, opts *ListenOptions)(*Listener, error) {
+	var s *SocketSpec
+	var l net.Listener
+	var err error
+
+	s, err = ParseSocketSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Family == "unix" {
+		err = removeStaleSocket(s.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l, err = net.Listen(s.Network(), s.Address())
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Family != "unix" {
+		return &Listener{Listener: l, Spec: s}, nil
+	}
+
+	err = applyListenOptions(s.Path, opts)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return &Listener{Listener: l, Spec: s, path: s.Path}, nil
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "io/ioutil"
+import "net"
+import "os"
+import "path/filepath"
+import "reflect"
+import "testing"
+
+func Test_socketSpec(t *testing.T) {
+	var spec *SocketSpec
+	var err error
+	var in string
+	var tests map[string]*SocketSpec = map[string]*SocketSpec{
+		"unix:/var/run/milter.sock":  &SocketSpec{Family: "unix", Path: "/var/run/milter.sock"},
+		"local:/var/run/milter.sock": &SocketSpec{Family: "unix", Path: "/var/run/milter.sock"},
+		"/var/run/milter.sock":       &SocketSpec{Family: "unix", Path: "/var/run/milter.sock"},
+		"inet:8891@127.0.0.1":        &SocketSpec{Family: "inet", Host: "127.0.0.1", Port: 8891},
+		"inet:127.0.0.1:8891":        &SocketSpec{Family: "inet", Host: "127.0.0.1", Port: 8891},
+		"inet:8891":                  &SocketSpec{Family: "inet", Port: 8891},
+		"inet6:8891@[::1]":           &SocketSpec{Family: "inet6", Host: "::1", Port: 8891},
+		"inet6:8891@::1":             &SocketSpec{Family: "inet6", Host: "::1", Port: 8891},
+		"inet6:[::1]:8891":           &SocketSpec{Family: "inet6", Host: "::1", Port: 8891},
+	}
+
+	for in = range tests {
+		spec, err = ParseSocketSpec(in)
+		if err != nil {
+			t.Errorf("%s: %s", in, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(spec, tests[in]) {
+			t.Errorf("%s: decoded %#v not match expected %#v", in, spec, tests[in])
+		}
+	}
+
+	for _, in = range []string{"", "unix:", "inet:port@host", "inet:70000", "tcp:1234", "milter.sock"} {
+		_, err = ParseSocketSpec(in)
+		if err == nil {
+			t.Errorf("%s: expect error", in)
+		}
+	}
+
+	spec, _ = ParseSocketSpec("inet6:8891@[::1]")
+	if spec.Network() != "tcp6" || spec.Address() != "[::1]:8891" {
+		t.Errorf("unexpected network %q or address %q", spec.Network(), spec.Address())
+	}
+}
+
+func Test_listenUnix(t *testing.T) {
+	var dir string
+	var path string
+	var l *Listener
+	var stale net.Listener
+	var info os.FileInfo
+	var err error
+
+	dir, err = ioutil.TempDir("", "milter")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path = filepath.Join(dir, "milter.sock")
+
+	// Create stale socket file: the listener is closed without unlink
+	stale, err = net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err = Listen("unix:" + path, &ListenOptions{Mode: 0660})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("expect mode 0660, got %o", info.Mode().Perm())
+	}
+
+	// Socket in use must not be removed
+	_, err = Listen("unix:" + path, nil)
+	if err == nil {
+		t.Errorf("expect error on socket in use")
+	}
+
+	l.Close()
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Errorf("expect socket file removed on close")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "fmt"
+import "io"
+
+// Optional interface of ServerCallbacks. If the callbacks implement it, the
+// body is delivered as an io.Reader in place of the calls to OnBODY and
+// OnBODYEOB. OnBODYSTREAM runs in its own goroutine, started with the first
+// body chunk. Exchange writes the chunks in the reader as they are received
+// and answers CONTINUE to the MTA, then the reader returns io.EOF when
+// BODYEOB is received. The modifications and the action returned by
+// OnBODYSTREAM are sent as BODYEOB response. If the message is aborted, the
+// reader returns an error and the result is ignored. The function could
+// return before reading the whole body, the remaining chunks are ignored.
+// Chain and Composite stream the body to the handlers implementing it.
+//
+// The *Server is not passed because Exchange keeps using it while the
+// callback runs. tx and macros are copies taken at the first body chunk,
+// they are not modified by Exchange, so the callback could read them
+// without synchronization. The BodySize of tx is the size of the first
+// chunk.
+type BodyStreamer interface {
+	OnBODYSTREAM(tx *Transaction, macros *MacroStore, body io.Reader)([]*Modification, *Action, error)
+}
+
+type bodyStream struct {
+	writer *io.PipeWriter
+	done chan struct{}
+	modifications []*Modification
+	action *Action
+	err error
+}
+
+// Start the streaming goroutine. The transaction and the macros of srv are
+// copied.
+func (bs *bodyStream)start(srv *Server, streamer BodyStreamer) {
+	var reader *io.PipeReader
+	var tx *Transaction
+	var macros *MacroStore
+
+	reader, bs.writer = io.Pipe()
+	bs.done = make(chan struct{})
+	tx = srv.transaction.clone()
+	macros = srv.Macros.clone()
+	go func() {
+		bs.modifications, bs.action, bs.err = streamer.OnBODYSTREAM(tx, macros, reader)
+		reader.Close()
+		close(bs.done)
+	}()
+}
+
+// Write body chunk in the stream. If the callback already returned, the
+// chunk is ignored.
+func (bs *bodyStream)write(srv *Server, streamer BodyStreamer, body []byte) {
+	if bs.writer == nil {
+		bs.start(srv, streamer)
+	}
+	bs.writer.Write(body)
+}
+
+// Close the stream and returns the result of the callback
+func (bs *bodyStream)end(srv *Server, streamer BodyStreamer)([]*Modification, *Action, error) {
+	var mods []*Modification
+	var action *Action
+	var err error
+
+	if bs.writer == nil {
+		bs.start(srv, streamer)
+	}
+	bs.writer.Close()
+	<-bs.done
+	mods, action, err = bs.modifications, bs.action, bs.err
+	*bs = bodyStream{}
+	if err == nil && action == nil {
+		action = ActionContinue()
+	}
+	return mods, action, err
+}
+
+// Abort the running stream, if any
+func (bs *bodyStream)abort() {
+	if bs.writer == nil {
+		return
+	}
+	bs.writer.CloseWithError(fmt.Errorf("message aborted"))
+	<-bs.done
+	*bs = bodyStream{}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+import "time"
+
+// This struct describes one packet sent or received by a Client or a
+// Server. Side is "client" or "server" and ConnID is the id of the
+// connection. Frame is the raw packet, including the length. MsgType and
+// Value are the decoded message, see Decode to understand cast between
+// MsgType and interface{}. If the packet can't be decoded, Err is filled
+// and Value is nil.
+type TapEvent struct {
+	Time time.Time
+	Side string
+	ConnID uint64
+	Direction Direction
+	MsgType MsgType
+	Value interface{}
+	Err error
+	Frame []byte
+}
+
+// Tap function receives each packet sent or received. The taps are called
+// synchronously by the I/O functions, so they must not block. The event and
+// its buffers must not be modified or kept after the function returns,
+// copy them if necessary.
+type Tap func(*TapEvent)
+
+// Decode the frame and call each tap.
+func runTaps(taps []Tap, side string, id uint64, dir Direction, frame []byte) {
+	var event *TapEvent
+	var tap Tap
+
+	event = &TapEvent{
+		Time: time.Now(),
+		Side: side,
+		ConnID: id,
+		Direction: dir,
+		Frame: frame,
+	}
+	if len(frame) > 4 {
+		event.MsgType, event.Value, event.Err = Decode(frame[4:])
+		if event.Err != nil {
+			event.MsgType = toMsgType(frame[4])
+			event.Value = nil
+		}
+	}
+
+	for _, tap = range taps {
+		tap(event)
+	}
+}
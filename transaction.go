@@ -0,0 +1,74 @@
+// Copyright (c) 2022 Thierry FOURNIER (tfournier@arpalert.org)
+
+package milter
+
+// This struct is filled by the Exchange loop with the received commands, so
+// it is available from any callback using srv.Transaction(). Connect and
+// Helo are connection data, they are kept until a new CONNECT. The other
+// fields concern the current message, they are reset after BODYEOB, ABORT
+// and on a new MAIL. The recipients rejected by the callback are not kept.
+// BodySize is the number of body bytes received. The content must not be
+// modified by the callbacks.
+type Transaction struct {
+	Connect *MsgConnect
+	Helo string
+	Mail *MsgMail
+	Rcpts []*MsgMail
+	Headers []*MsgHeader
+	BodySize int64
+}
+
+// Returns the current transaction. The pointer stays valid during the
+// connection, but its content changes with each message.
+func (srv *Server)Transaction()(*Transaction) {
+	return &srv.transaction
+}
+
+// Returns a copy of the transaction which doesn't share the lists
+func (t *Transaction)clone()(*Transaction) {
+	var c Transaction
+
+	c = *t
+	c.Rcpts = append([]*MsgMail(nil), t.Rcpts...)
+	c.Headers = append([]*MsgHeader(nil), t.Headers...)
+	return &c
+}
+
+// Reset the message fields
+func (t *Transaction)resetMessage() {
+	t.Mail = nil
+	t.Rcpts = nil
+	t.Headers = nil
+	t.BodySize = 0
+}
+
+// Record received message in the transaction. This is called before the
+// callback.
+func (t *Transaction)record(msgType MsgType, msg interface{}) {
+	switch msgType {
+	case SMFIC_CONNECT:
+		*t = Transaction{Connect: msg.(*MsgConnect)}
+	case SMFIC_HELO:
+		t.Helo = msg.(string)
+		t.resetMessage()
+	case SMFIC_MAIL:
+		t.resetMessage()
+		t.Mail = msg.(*MsgMail)
+	case SMFIC_RCPT:
+		t.Rcpts = append(t.Rcpts, msg.(*MsgMail))
+	case SMFIC_HEADER:
+		t.Headers = append(t.Headers, msg.(*MsgHeader))
+	case SMFIC_BODY:
+		t.BodySize += int64(len(msg.([]byte)))
+	}
+}
+
+// Remove last recipient if the callback rejects it
+func (t *Transaction)rcptAction(action *Action) {
+	switch action.Action {
+	case AC_REJECT, AC_TEMPFAIL, AC_REPLYCODE:
+		if len(t.Rcpts) > 0 {
+			t.Rcpts = t.Rcpts[:len(t.Rcpts) - 1]
+		}
+	}
+}